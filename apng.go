@@ -0,0 +1,266 @@
+package api
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// prefersAPNG reports whether an Accept header names image/apng and gives
+// it a higher quality than image/gif. GIFs are smaller and already stored,
+// so they're served whenever the client is as happy with one.
+func prefersAPNG(accept string) bool {
+	apngQ, apngExact := acceptQuality(accept, "image/apng")
+	gifQ, _ := acceptQuality(accept, "image/gif")
+	return apngExact && apngQ > 0 && apngQ > gifQ
+}
+
+// acceptQuality returns the quality an Accept header gives mediaType, going
+// by the most specific range that matches it, and whether that range names
+// mediaType outright. Types the header doesn't match get -1.
+func acceptQuality(accept, mediaType string) (float64, bool) {
+	quality, specificity := -1.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch {
+		case mediaRange == mediaType:
+			s = 2
+		case mediaRange == mediaType[:strings.Index(mediaType, "/")]+"/*":
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		valid := true
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == "q" {
+				var err error
+				q, err = strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				valid = err == nil && q >= 0 && q <= 1
+			}
+		}
+		if valid {
+			quality, specificity = q, s
+		}
+	}
+	return quality, specificity == 2
+}
+
+// apngName is where the APNG version of a blob, with t applied, is stored.
+func apngName(blob string, t Transform) string {
+	return renditionName(blob, t, ".apng")
+}
+
+type encodedFrame struct {
+	bounds image.Rectangle
+	delay  int // in hundredths of a second
+	data   []byte
+}
+
+// encodeAPNG writes g as an animated PNG. Frames are drawn over the frames
+// before them first, so the APNG keeps every color that ends up on screen
+// instead of each GIF frame's palette. Each APNG frame only covers what
+// changed since the one before it; frames that change nothing are merged
+// into the frame before them.
+func encodeAPNG(w io.Writer, g *gif.GIF) error {
+	bounds := gifBounds(g)
+	if bounds.Empty() || len(g.Image) < 1 {
+		return CorruptImageError
+	}
+	if !fitsFlattened(g) {
+		return PartTooLargeError
+	}
+	previous := image.NewRGBA(bounds)
+	var frames []encodedFrame
+	var err error
+	// compositeFrames can't fail, since g fits
+	compositeFrames(g, func(i int, canvas *image.RGBA) {
+		if err != nil {
+			return
+		}
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		changed := bounds
+		if i > 0 {
+			changed = changedPixels(previous, canvas)
+		}
+		if changed.Empty() {
+			frames[len(frames)-1].delay += delay
+			return
+		}
+		var data []byte
+		data, err = apngImageData(canvas.SubImage(changed).(*image.RGBA))
+		frames = append(frames, encodedFrame{bounds: changed, delay: delay, data: data})
+		copy(previous.Pix, canvas.Pix)
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+	ihdr[8] = 8 // bits per channel
+	ihdr[9] = 6 // RGBA
+	writePNGChunk(&buf, "IHDR", ihdr)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(apngPlays(g.LoopCount)))
+	writePNGChunk(&buf, "acTL", actl)
+	var sequence uint32
+	for i, f := range frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], sequence)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(f.bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(f.bounds.Dy()))
+		binary.BigEndian.PutUint32(fctl[12:], uint32(f.bounds.Min.X-bounds.Min.X))
+		binary.BigEndian.PutUint32(fctl[16:], uint32(f.bounds.Min.Y-bounds.Min.Y))
+		if f.delay > math.MaxUint16 {
+			f.delay = math.MaxUint16
+		}
+		binary.BigEndian.PutUint16(fctl[20:], uint16(f.delay))
+		binary.BigEndian.PutUint16(fctl[22:], 100)
+		// fctl[24] and fctl[25] leave the frame in place when it's done,
+		// and replace what's under it rather than blending with it
+		writePNGChunk(&buf, "fcTL", fctl)
+		sequence++
+		if i == 0 {
+			writePNGChunk(&buf, "IDAT", f.data)
+			continue
+		}
+		fdat := make([]byte, 4, 4+len(f.data))
+		binary.BigEndian.PutUint32(fdat, sequence)
+		writePNGChunk(&buf, "fdAT", append(fdat, f.data...))
+		sequence++
+	}
+	writePNGChunk(&buf, "IEND", nil)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// apngPlays converts a GIF loop count to the number of times an APNG
+// plays, where zero means forever.
+func apngPlays(loopCount int) int {
+	switch {
+	case loopCount == 0:
+		return 0
+	case loopCount < 0:
+		return 1
+	}
+	return loopCount + 1
+}
+
+// changedPixels returns the smallest rectangle holding every pixel that's
+// different in a and b.
+func changedPixels(a, b *image.RGBA) image.Rectangle {
+	var changed image.Rectangle
+	bounds := b.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if a.RGBAAt(x, y) != b.RGBAAt(x, y) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return changed
+}
+
+// apngImageData filters and compresses img the way PNG image data is
+// stored. GIF pixels are either fully opaque or fully transparent, so img's
+// premultiplied colors can be written as they are.
+func apngImageData(img *image.RGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	bounds := img.Bounds()
+	width := bounds.Dx() * 4
+	prior := make([]byte, width)
+	filtered := make([][]byte, 5)
+	for i := range filtered {
+		filtered[i] = make([]byte, width+1)
+		filtered[i][0] = byte(i)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):][:width]
+		best := filterRow(filtered, row, prior)
+		_, err := z.Write(filtered[best])
+		if err != nil {
+			return nil, err
+		}
+		prior = row
+	}
+	err := z.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filterRow fills filtered with row run through each of PNG's filters, and
+// returns the one likely to compress best: the one with the smallest sum
+// of absolute differences, as the PNG spec suggests.
+func filterRow(filtered [][]byte, row, prior []byte) int {
+	const bpp = 4
+	best, bestSum := 0, math.MaxInt64
+	for f := range filtered {
+		out := filtered[f][1:]
+		sum := 0
+		for i, x := range row {
+			var a, b, c byte
+			if i >= bpp {
+				a, c = row[i-bpp], prior[i-bpp]
+			}
+			b = prior[i]
+			switch f {
+			case 0:
+				out[i] = x
+			case 1:
+				out[i] = x - a
+			case 2:
+				out[i] = x - b
+			case 3:
+				out[i] = x - byte((int(a)+int(b))/2)
+			case 4:
+				out[i] = x - paeth(a, b, c)
+			}
+			sum += absInt(int(int8(out[i])))
+		}
+		if sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return best
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
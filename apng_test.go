@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func TestPrefersAPNG(t *testing.T) {
+	cases := map[string]bool{
+		"":                                 false,
+		"*/*":                              false,
+		"image/gif":                        false,
+		"image/apng":                       true,
+		"IMAGE/APNG":                       true,
+		"image/apng,image/gif":             false,
+		"image/apng;q=0.5,image/gif":       false,
+		"image/apng;q=0.9,image/gif;q=0.8": true,
+		"image/apng,image/*;q=0.8":         true,
+		"image/apng;q=0,*/*":               false,
+		"image/apng;q=bogus,image/*;q=0.5": false,
+		"image/*;q=1,image/gif;q=0.5":      false,
+		"text/html,application/xhtml+xml,image/avif,image/webp,image/apng,*/*;q=0.8": true,
+		// browsers name image/apng, but take GIFs through image/* just as
+		// happily
+		"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8": false,
+		"image/gif;q=0.1, image/apng ; q=0.2":                              true,
+	}
+	for accept, expected := range cases {
+		if got := prefersAPNG(accept); got != expected {
+			t.Errorf("Expected prefersAPNG(%q) to be %v", accept, expected)
+		}
+	}
+}
+
+func TestEncodeAPNG(t *testing.T) {
+	pal := color.Palette{color.Transparent, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	full := image.NewPaletted(image.Rect(0, 0, 10, 10), pal)
+	for i := range full.Pix {
+		full.Pix[i] = 1
+	}
+	part := image.NewPaletted(image.Rect(5, 5, 10, 10), pal)
+	for i := range part.Pix {
+		part.Pix[i] = 2
+	}
+	dot := image.NewPaletted(image.Rect(0, 0, 1, 1), pal)
+	dot.Pix[0] = 2
+	same := image.NewPaletted(image.Rect(0, 0, 1, 1), pal)
+	same.Pix[0] = 2
+	src := &gif.GIF{
+		Image:     []*image.Paletted{full, part, dot, same},
+		Delay:     []int{10, 20, 30, 40},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone, gif.DisposalNone},
+		Config:    image.Config{Width: 10, Height: 10},
+		LoopCount: -1,
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(encodedGIF(t, src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = encodeAPNG(&buf, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// browsers that don't know about APNGs show the first frame
+	first, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Bounds() != image.Rect(0, 0, 10, 10) {
+		t.Errorf("Expected the first frame to cover the whole image, got %v", first.Bounds())
+	}
+	if r, _, _, _ := first.At(7, 7).RGBA(); r != 0xffff {
+		t.Error("Expected the first frame to be red")
+	}
+
+	back, err := decodeAPNG(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.LoopCount != -1 {
+		t.Errorf("Expected the APNG to play once, got loop count %d", back.LoopCount)
+	}
+	// the last frame doesn't change anything, so it's merged away
+	expectedDelays := []int{10, 20, 70}
+	if len(back.Delay) != len(expectedDelays) {
+		t.Fatalf("Expected delays %v, got %v", expectedDelays, back.Delay)
+	}
+	for i := range expectedDelays {
+		if back.Delay[i] != expectedDelays[i] {
+			t.Errorf("Expected delays %v, got %v", expectedDelays, back.Delay)
+			break
+		}
+	}
+	before, after := composited(t, g), composited(t, back)
+	for i := range after {
+		if !bytes.Equal(before[i].Pix, after[i].Pix) {
+			t.Errorf("Expected frame %d to look the same as an APNG", i)
+		}
+	}
+}
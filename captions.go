@@ -0,0 +1,151 @@
+package api
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// MaxCaptionLength is the longest a top or bottom caption can be, in bytes.
+const MaxCaptionLength = 256
+
+var (
+	captionFill    = color.RGBA{255, 255, 255, 255}
+	captionOutline = color.RGBA{0, 0, 0, 255}
+	captionFont    = mustParseFont(gobold.TTF)
+)
+
+func mustParseFont(ttf []byte) *opentype.Font {
+	f, err := opentype.Parse(ttf)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Caption returns a copy of g with top and bottom written across the top
+// and bottom of every frame, in white with a black outline. Either can be
+// empty. GIFs that are too big to draw fail with PartTooLargeError.
+func Caption(g *gif.GIF, top, bottom string) (*gif.GIF, error) {
+	if !fitsFlattened(g) {
+		return nil, PartTooLargeError
+	}
+	bounds := gifBounds(g)
+	overlay := image.NewRGBA(bounds)
+	err := drawCaption(overlay, captionFont, top, true)
+	if err != nil {
+		return nil, err
+	}
+	err = drawCaption(overlay, captionFont, bottom, false)
+	if err != nil {
+		return nil, err
+	}
+	// the canvas carries over from frame to frame, so the caption goes on
+	// a copy of it; drawing it on the canvas itself would thicken the
+	// caption's antialiased edges with every frame.
+	captioned := image.NewRGBA(bounds)
+	return flattenFrames(g, []color.Color{captionFill, captionOutline}, func(canvas *image.RGBA) *image.RGBA {
+		draw.Draw(captioned, bounds, canvas, bounds.Min, draw.Src)
+		draw.Draw(captioned, bounds, overlay, bounds.Min, draw.Over)
+		return captioned
+	})
+}
+
+// drawCaption writes text centered at the top or bottom of dst, wrapping
+// it onto as many lines as it needs and shrinking the font until it takes
+// up no more than a third of the image.
+func drawCaption(dst *image.RGBA, f *opentype.Font, text string, top bool) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	bounds := dst.Bounds()
+	margin := bounds.Dy() / 20
+	maxWidth := bounds.Dx() - 2*margin
+	size := float64(bounds.Dy()) / 7
+	var face font.Face
+	var lines []string
+	for {
+		var err error
+		face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return err
+		}
+		lines = wrapCaption(face, text, maxWidth)
+		if size <= 6 || captionFits(face, lines, maxWidth, bounds.Dy()/3) {
+			break
+		}
+		face.Close()
+		size *= 0.9
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	y := bounds.Min.Y + margin + metrics.Ascent.Ceil()
+	if !top {
+		y = bounds.Max.Y - margin - metrics.Descent.Ceil() - (len(lines)-1)*lineHeight
+	}
+	outline := int(size / 15)
+	if outline < 1 {
+		outline = 1
+	}
+	d := &font.Drawer{Dst: dst, Face: face}
+	for _, line := range lines {
+		x := bounds.Min.X + (bounds.Dx()-d.MeasureString(line).Ceil())/2
+		d.Src = image.NewUniform(captionOutline)
+		for dx := -outline; dx <= outline; dx++ {
+			for dy := -outline; dy <= outline; dy++ {
+				if dx*dx+dy*dy > outline*outline {
+					continue
+				}
+				d.Dot = fixed.P(x+dx, y+dy)
+				d.DrawString(line)
+			}
+		}
+		d.Src = image.NewUniform(captionFill)
+		d.Dot = fixed.P(x, y)
+		d.DrawString(line)
+		y += lineHeight
+	}
+	return nil
+}
+
+// wrapCaption splits text into lines no wider than maxWidth, breaking
+// between words. A single word wider than maxWidth gets a line to itself.
+func wrapCaption(face font.Face, text string, maxWidth int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line == "" {
+			line = word
+			continue
+		}
+		if font.MeasureString(face, line+" "+word).Ceil() <= maxWidth {
+			line += " " + word
+			continue
+		}
+		lines = append(lines, line)
+		line = word
+	}
+	return append(lines, line)
+}
+
+func captionFits(face font.Face, lines []string, maxWidth, maxHeight int) bool {
+	if len(lines)*face.Metrics().Height.Ceil() > maxHeight {
+		return false
+	}
+	for _, line := range lines {
+		if font.MeasureString(face, line).Ceil() > maxWidth {
+			return false
+		}
+	}
+	return true
+}
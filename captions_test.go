@@ -0,0 +1,99 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestCaption(t *testing.T) {
+	pal := color.Palette{color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255}}
+	src := &gif.GIF{LoopCount: 1, Config: image.Config{Width: 120, Height: 80}}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 120, 80), pal)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i % 2)
+		}
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 10)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(encodedGIF(t, src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	captioned, err := Caption(g, "when the build", "finally passes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := gif.DecodeAll(bytes.NewReader(encodedGIF(t, captioned)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Image) != 3 || out.Config.Width != 120 || out.Config.Height != 80 || out.LoopCount != 1 {
+		t.Fatalf("Expected a 120x80 GIF with 3 frames looping once, got %dx%d with %d frames looping %d", out.Config.Width, out.Config.Height, len(out.Image), out.LoopCount)
+	}
+	count := func(frame *image.Paletted, rows image.Rectangle, c color.Color) int {
+		n := 0
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				if frame.At(x, y) == c {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	top, middle, bottom := image.Rect(0, 0, 120, 25), image.Rect(0, 30, 120, 50), image.Rect(0, 55, 120, 80)
+	for i, frame := range out.Image {
+		if count(frame, top, captionFill) == 0 || count(frame, top, captionOutline) == 0 {
+			t.Errorf("Expected frame %d to have a caption at the top", i)
+		}
+		if count(frame, bottom, captionFill) == 0 {
+			t.Errorf("Expected frame %d to have a caption at the bottom", i)
+		}
+		if count(frame, middle, captionFill) != 0 {
+			t.Errorf("Expected frame %d to have nothing written across the middle", i)
+		}
+		if count(frame, middle, pal[i%2]) != middle.Dx()*middle.Dy() {
+			t.Errorf("Expected frame %d to keep its own colors in the middle", i)
+		}
+	}
+	// the caption is drawn the same way on every frame
+	if count(out.Image[0], top, captionFill) != count(out.Image[2], top, captionFill) {
+		t.Error("Expected the caption to look the same on every frame")
+	}
+}
+
+func TestWrapCaption(t *testing.T) {
+	overlay := image.NewRGBA(image.Rect(0, 0, 60, 200))
+	err := drawCaption(overlay, captionFont, "a caption far too long to fit on one line", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the text is wrapped and shrunk to fit, so nothing touches the sides
+	for y := 0; y < 200; y++ {
+		if overlay.RGBAAt(0, y).A != 0 || overlay.RGBAAt(59, y).A != 0 {
+			t.Fatalf("Expected the caption to stay off the edges, found it at row %d", y)
+		}
+	}
+	lines := 0
+	inLine := false
+	for y := 0; y < 200; y++ {
+		drawn := false
+		for x := 0; x < 60; x++ {
+			if overlay.RGBAAt(x, y).A != 0 {
+				drawn = true
+				break
+			}
+		}
+		if drawn && !inLine {
+			lines++
+		}
+		inLine = drawn
+	}
+	if lines < 2 {
+		t.Errorf("Expected the caption to be wrapped, got %d lines", lines)
+	}
+}
@@ -2,6 +2,9 @@ package api
 
 import (
 	"database/sql"
+	"net/http"
+	"net/url"
+	"os"
 
 	"code.google.com/p/goauth2/oauth/jwt"
 	"code.google.com/p/google-api-go-client/storage/v1beta2"
@@ -9,12 +12,26 @@ import (
 )
 
 type Context struct {
-	Storage      Storage
-	Datastore    Datastore
-	UsageTracker *UsageTracker
-	Authorizer   Authorizer
-	Bucket       string
-	RootDomain   string
+	Storage        Storage
+	Datastore      Datastore
+	UsageTracker   *UsageTracker
+	Authorizer     Authorizer
+	Bucket         string
+	RootDomain     string
+	SigningKeys    map[string][]byte
+	SigningKeyID   string
+	AllowedTypes   []string
+	ThumbnailSizes []int
+	// Re-encode uploaded GIFs, and store them that way if it saves space.
+	OptimizeUploads bool
+	// Keep the originals of uploads that are converted to GIFs.
+	KeepOriginals bool
+
+	// Zero means unlimited. UserQuota bounds the total Size of the items
+	// each user has uploaded.
+	MaxPartSize    int64
+	MaxRequestSize int64
+	UserQuota      int64
 }
 
 func NewMemStorage() Storage {
@@ -25,6 +42,14 @@ func NewMemDatastore() Datastore {
 	return make(Memstore)
 }
 
+func NewFilesystemStorage(root string) (Storage, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return FilesystemStorage{Root: root}, nil
+}
+
 func NewGCSStorage(gcsClientEmail, gcsTokenURI string, gcsPemBytes []byte) (Storage, error) {
 	t := jwt.NewToken(gcsClientEmail, storage.DevstorageFull_controlScope, gcsPemBytes)
 	t.ClaimSet.Aud = gcsTokenURI
@@ -32,12 +57,39 @@ func NewGCSStorage(gcsClientEmail, gcsTokenURI string, gcsPemBytes []byte) (Stor
 	if err != nil {
 		return nil, err
 	}
-	client := transport.Client()
+	return NewGCSStorageFromClient(transport.Client(), "")
+}
+
+func NewGCSStorageFromClient(client *http.Client, basePath string) (Storage, error) {
 	gcsService, err := storage.New(client)
 	if err != nil {
 		return nil, err
 	}
-	return &GoogleCloudStorage{gcsService}, nil
+	if basePath != "" {
+		gcsService.BasePath = basePath
+	}
+	return &GoogleCloudStorage{Service: gcsService, client: client}, nil
+}
+
+func NewS3Storage(endpoint, region, accessKey, secretKey string) (Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, InvalidS3EndpointError
+	}
+	if region == "" {
+		region = DefaultS3Region
+	}
+	return &S3Storage{
+		Endpoint:  u,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PartSize:  DefaultS3PartSize,
+		Client:    http.DefaultClient,
+	}, nil
 }
 
 func NewMySQLDatastore(dsn string) (Datastore, error) {
@@ -0,0 +1,572 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+
+	"code.google.com/p/go-uuid/uuid"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// MaxConvertedPixels bounds the GIF an upload is converted to, counting
+// every pixel of every frame, since a small upload can unpack into a lot of
+// frames.
+const MaxConvertedPixels = MaxGIFPixels
+
+// MaxConvertedCanvasPixels bounds the width times the height of an upload
+// that's converted to a GIF. Every frame is drawn at that size, and a few
+// frames' worth are held at once while converting.
+const MaxConvertedCanvasPixels = 1 << 22
+
+// MaxConvertedSize is the most of an upload that's read into memory to be
+// converted to a GIF, whatever MaxPartSize is.
+const MaxConvertedSize = 32 << 20
+
+// MaxConcurrentConversions is how many uploads are converted to GIFs at
+// once. Uploads past that wait their turn.
+const MaxConcurrentConversions = 4
+
+var conversions = make(chan struct{}, MaxConcurrentConversions)
+
+var (
+	MalformedAnimationError = errors.New("malformed animation")
+	StillImageError         = errors.New("image isn't animated")
+)
+
+// convertible reports whether uploads of contentType are converted to GIFs
+// before they're stored. Only animated ones are accepted.
+func convertible(contentType string) bool {
+	return contentType == "image/png" || contentType == "image/webp"
+}
+
+// readAnimationHeader reads from r until it can tell whether the PNG or WebP
+// being read is animated: a PNG is if it has an acTL chunk before its image
+// data, and a WebP is if its VP8X chunk has the animation flag set. It
+// returns everything it read. Files too short or too strange to tell are
+// taken to be still images.
+func readAnimationHeader(contentType string, r io.Reader) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	tee := io.TeeReader(io.LimitReader(r, MaxConvertedSize), &buf)
+	var animated bool
+	var err error
+	switch contentType {
+	case "image/png":
+		animated, err = pngAnimated(tee)
+	case "image/webp":
+		animated, err = webpAnimated(tee)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf.Bytes(), animated, err
+}
+
+func pngAnimated(r io.Reader) (bool, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil || string(header) != pngSignature {
+		return false, err
+	}
+	for {
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			return false, err
+		}
+		switch string(header[4:]) {
+		case "acTL":
+			return true, nil
+		case "IDAT", "IEND":
+			return false, nil
+		}
+		// skip the chunk's data and CRC
+		_, err = io.CopyN(ioutil.Discard, r, int64(binary.BigEndian.Uint32(header))+4)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func webpAnimated(r io.Reader) (bool, error) {
+	// the RIFF header, then the first chunk's header and flags
+	header := make([]byte, 21)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return false, err
+	}
+	return string(header[:4]) == "RIFF" && string(header[8:16]) == "WEBPVP8X" && header[20]&0x02 != 0, nil
+}
+
+// convertToGIF decodes an APNG or animated WebP and returns it as a GIF.
+func convertToGIF(contentType string, data []byte) (*gif.GIF, error) {
+	switch contentType {
+	case "image/png":
+		return decodeAPNG(data)
+	case "image/webp":
+		return decodeAnimatedWebP(data)
+	}
+	return nil, UnsupportedTypeError
+}
+
+// convertedUpload converts an upload to a GIF and encodes it, once fewer
+// than MaxConcurrentConversions other uploads are being converted.
+func convertedUpload(ctx context.Context, contentType string, data []byte) ([]byte, error) {
+	select {
+	case conversions <- struct{}{}:
+		defer func() { <-conversions }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	g, err := convertToGIF(contentType, data)
+	if err == PartTooLargeError {
+		return nil, err
+	} else if err != nil {
+		return nil, CorruptImageError
+	}
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, g)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// storeOriginal saves the upload a GIF was converted from as a blob of its
+// own, named after its hash like any other blob.
+func storeOriginal(ctx context.Context, c Context, data []byte, listable bool) (string, error) {
+	sum := sha1.Sum(data)
+	name := blobName(hex.EncodeToString(sum[:]), listable)
+	tmp := "tmp/" + uuid.NewRandom().String()
+	_, err := GetObjectStorage(c).Put(ctx, c.Bucket, tmp, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	err = moveIntoPlace(c, c.Bucket, tmp, c.Bucket, name, listable)
+	if err != nil {
+		del(c.Bucket, tmp, c)
+		return "", err
+	}
+	return name, nil
+}
+
+// animationFrame is a frame of an APNG or animated WebP, positioned on the
+// animation's canvas.
+type animationFrame struct {
+	img     image.Image
+	bounds  image.Rectangle
+	delay   int  // in hundredths of a second
+	blend   bool // draw over the canvas, instead of replacing what's there
+	dispose byte // one of the gif.Disposal constants, or zero
+}
+
+// animation composites the frames of an APNG or animated WebP and turns
+// the results into GIF frames. Every GIF frame covers the whole canvas.
+// flat and previous are scratch space, kept between frames so each frame
+// doesn't allocate its own.
+type animation struct {
+	g           gif.GIF
+	canvas      *image.RGBA
+	flat        *image.RGBA
+	previous    *image.RGBA
+	pixels      int
+	transparent bool
+}
+
+func newAnimation(width, height int) (*animation, error) {
+	// GIFs can't be any bigger than 65535x65535
+	if width < 1 || height < 1 || width > 65535 || height > 65535 || width > MaxConvertedCanvasPixels/height {
+		return nil, PartTooLargeError
+	}
+	bounds := image.Rect(0, 0, width, height)
+	return &animation{
+		g:      gif.GIF{Config: image.Config{Width: width, Height: height}},
+		canvas: image.NewRGBA(bounds),
+		flat:   image.NewRGBA(bounds),
+	}, nil
+}
+
+// add draws f on the canvas and adds the result as the next GIF frame.
+func (a *animation) add(f animationFrame) error {
+	bounds := a.canvas.Bounds()
+	if !f.bounds.In(bounds) {
+		return MalformedAnimationError
+	}
+	a.pixels += bounds.Dx() * bounds.Dy()
+	if a.pixels > MaxConvertedPixels {
+		return PartTooLargeError
+	}
+	if f.dispose == gif.DisposalPrevious {
+		if a.previous == nil {
+			a.previous = image.NewRGBA(bounds)
+		}
+		copy(a.previous.Pix, a.canvas.Pix)
+	}
+	op := draw.Src
+	if f.blend {
+		op = draw.Over
+	}
+	draw.Draw(a.canvas, f.bounds, f.img, f.img.Bounds().Min, op)
+
+	// GIF pixels are either fully transparent or fully opaque
+	flat := a.flat
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := a.canvas.RGBAAt(x, y)
+			if c.A < 128 {
+				a.transparent = true
+				c = color.RGBA{}
+			} else if c.A < 255 {
+				c = color.RGBA{unpremultiply(c.R, c.A), unpremultiply(c.G, c.A), unpremultiply(c.B, c.A), 255}
+			}
+			flat.SetRGBA(x, y, c)
+		}
+	}
+	p, ok := exactPalette(flat)
+	if !ok {
+		p = append(color.Palette{color.RGBA{}}, palette.Plan9[:255]...)
+	}
+	frame := image.NewPaletted(bounds, p)
+	draw.FloydSteinberg.Draw(frame, bounds, flat, bounds.Min)
+	a.g.Image = append(a.g.Image, frame)
+	a.g.Delay = append(a.g.Delay, f.delay)
+
+	switch f.dispose {
+	case gif.DisposalBackground:
+		draw.Draw(a.canvas, f.bounds, image.Transparent, image.Point{}, draw.Src)
+	case gif.DisposalPrevious:
+		a.canvas, a.previous = a.previous, a.canvas
+	}
+	return nil
+}
+
+func unpremultiply(c, a uint8) uint8 {
+	return uint8(uint32(c) * 255 / uint32(a))
+}
+
+// gif returns the finished GIF. plays is how many times the animation
+// should play, or zero to loop forever.
+func (a *animation) gif(plays int) *gif.GIF {
+	// GIF frames are drawn over the frames before them, so if any part of
+	// the animation is transparent, each frame has to be cleared away.
+	if a.transparent {
+		a.g.Disposal = make([]byte, len(a.g.Image))
+		for i := range a.g.Disposal {
+			a.g.Disposal[i] = gif.DisposalBackground
+		}
+	}
+	// a GIF's loop count is how many times to play it again
+	switch plays {
+	case 0:
+		a.g.LoopCount = 0
+	case 1:
+		a.g.LoopCount = -1
+	default:
+		a.g.LoopCount = plays - 1
+	}
+	return &a.g
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// decodeAPNG decodes an APNG's animation. image/png only decodes the
+// default image, so each frame is rebuilt as a PNG of its own and decoded
+// separately. PNGs that aren't animated fail with MalformedAnimationError.
+func decodeAPNG(data []byte) (*gif.GIF, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, MalformedAnimationError
+	}
+	var ihdr, plte, trns []byte
+	var plays int
+	animated := false
+	type apngFrame struct {
+		control []byte // the fcTL chunk
+		data    []byte
+	}
+	var frames []*apngFrame
+	var current *apngFrame
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length > len(data)-pos-12 {
+			return nil, MalformedAnimationError
+		}
+		kind := string(data[pos+4 : pos+8])
+		chunk := data[pos+8 : pos+8+length]
+		pos += 12 + length
+		switch kind {
+		case "IHDR":
+			ihdr = chunk
+		case "PLTE":
+			plte = chunk
+		case "tRNS":
+			trns = chunk
+		case "acTL":
+			if len(chunk) != 8 {
+				return nil, MalformedAnimationError
+			}
+			animated = true
+			plays = int(binary.BigEndian.Uint32(chunk[4:]))
+		case "fcTL":
+			if len(chunk) != 26 {
+				return nil, MalformedAnimationError
+			}
+			current = &apngFrame{control: chunk}
+			frames = append(frames, current)
+		case "IDAT":
+			// without an fcTL before it, the default image isn't part of
+			// the animation
+			if current != nil {
+				current.data = append(current.data, chunk...)
+			}
+		case "fdAT":
+			if current == nil || len(chunk) < 4 {
+				return nil, MalformedAnimationError
+			}
+			current.data = append(current.data, chunk[4:]...)
+		}
+		if kind == "IEND" {
+			break
+		}
+	}
+	if !animated || len(frames) < 1 || len(ihdr) != 13 {
+		return nil, MalformedAnimationError
+	}
+	a, err := newAnimation(int(binary.BigEndian.Uint32(ihdr[0:])), int(binary.BigEndian.Uint32(ihdr[4:])))
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range frames {
+		fc := f.control
+		width, height := binary.BigEndian.Uint32(fc[4:]), binary.BigEndian.Uint32(fc[8:])
+		x, y := binary.BigEndian.Uint32(fc[12:]), binary.BigEndian.Uint32(fc[16:])
+		delayNum, delayDen := int(binary.BigEndian.Uint16(fc[20:])), int(binary.BigEndian.Uint16(fc[22:]))
+		bounds := image.Rect(int(x), int(y), int(x)+int(width), int(y)+int(height))
+		if width < 1 || height < 1 || !bounds.In(a.canvas.Bounds()) {
+			return nil, MalformedAnimationError
+		}
+
+		header := append([]byte{}, ihdr...)
+		binary.BigEndian.PutUint32(header[0:], width)
+		binary.BigEndian.PutUint32(header[4:], height)
+		var still bytes.Buffer
+		still.WriteString(pngSignature)
+		writePNGChunk(&still, "IHDR", header)
+		if plte != nil {
+			writePNGChunk(&still, "PLTE", plte)
+		}
+		if trns != nil {
+			writePNGChunk(&still, "tRNS", trns)
+		}
+		writePNGChunk(&still, "IDAT", f.data)
+		writePNGChunk(&still, "IEND", nil)
+		img, err := png.Decode(&still)
+		if err != nil {
+			return nil, err
+		}
+
+		// a zero denominator means hundredths of a second
+		if delayDen == 0 {
+			delayDen = 100
+		}
+		frame := animationFrame{
+			img:    img,
+			bounds: bounds,
+			delay:  (delayNum*100 + delayDen/2) / delayDen,
+			blend:  fc[25] == 1,
+		}
+		switch fc[24] {
+		case 1:
+			frame.dispose = gif.DisposalBackground
+		case 2:
+			frame.dispose = gif.DisposalPrevious
+			// the first frame has nothing to go back to
+			if i == 0 {
+				frame.dispose = gif.DisposalBackground
+			}
+		}
+		err = a.add(frame)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a.gif(plays), nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, kind string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	buf.Write(n[:])
+	buf.WriteString(kind)
+	buf.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	buf.Write(n[:])
+}
+
+// riffChunk is a chunk of a WebP file.
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+// riffChunks splits data into chunks. Chunks are padded to an even length.
+func riffChunks(data []byte) ([]riffChunk, error) {
+	var chunks []riffChunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, MalformedAnimationError
+		}
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		if length > len(data)-8 {
+			return nil, MalformedAnimationError
+		}
+		chunks = append(chunks, riffChunk{string(data[:4]), data[8 : 8+length]})
+		data = data[8+length:]
+		if length%2 == 1 && len(data) > 0 {
+			data = data[1:]
+		}
+	}
+	return chunks, nil
+}
+
+func writeRIFFChunk(buf *bytes.Buffer, id string, data []byte) {
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(data)))
+	buf.WriteString(id)
+	buf.Write(n[:])
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// decodeAnimatedWebP decodes an animated WebP. golang.org/x/image/webp only
+// decodes still images, so each frame is rebuilt as a WebP of its own and
+// decoded separately. WebPs that aren't animated fail with
+// MalformedAnimationError.
+func decodeAnimatedWebP(data []byte) (*gif.GIF, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, MalformedAnimationError
+	}
+	size := int(binary.LittleEndian.Uint32(data[4:]))
+	if size < 4 || size > len(data)-8 {
+		return nil, MalformedAnimationError
+	}
+	chunks, err := riffChunks(data[12 : 8+size])
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) < 1 || chunks[0].id != "VP8X" || len(chunks[0].data) != 10 || chunks[0].data[0]&0x02 == 0 {
+		return nil, MalformedAnimationError
+	}
+	header := chunks[0].data
+	a, err := newAnimation(uint24(header[4:])+1, uint24(header[7:])+1)
+	if err != nil {
+		return nil, err
+	}
+	var plays int
+	for _, chunk := range chunks[1:] {
+		switch chunk.id {
+		case "ANIM":
+			if len(chunk.data) != 6 {
+				return nil, MalformedAnimationError
+			}
+			plays = int(binary.LittleEndian.Uint16(chunk.data[4:]))
+		case "ANMF":
+			frame, err := webpFrame(chunk.data, a.canvas.Bounds())
+			if err != nil {
+				return nil, err
+			}
+			err = a.add(frame)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(a.g.Image) < 1 {
+		return nil, MalformedAnimationError
+	}
+	return a.gif(plays), nil
+}
+
+// webpFrame decodes the contents of an ANMF chunk, checking that it fits
+// on the canvas before decoding it.
+func webpFrame(data []byte, canvas image.Rectangle) (animationFrame, error) {
+	if len(data) < 16 {
+		return animationFrame{}, MalformedAnimationError
+	}
+	x, y := uint24(data[0:])*2, uint24(data[3:])*2
+	width, height := uint24(data[6:])+1, uint24(data[9:])+1
+	frame := animationFrame{
+		bounds: image.Rect(x, y, x+width, y+height),
+		delay:  (uint24(data[12:]) + 5) / 10,
+		blend:  data[15]&0x02 == 0,
+	}
+	if !frame.bounds.In(canvas) {
+		return animationFrame{}, MalformedAnimationError
+	}
+	if data[15]&0x01 != 0 {
+		frame.dispose = gif.DisposalBackground
+	}
+	chunks, err := riffChunks(data[16:])
+	if err != nil {
+		return animationFrame{}, err
+	}
+	var alpha, bitstream *riffChunk
+	for i := range chunks {
+		switch chunks[i].id {
+		case "ALPH":
+			alpha = &chunks[i]
+		case "VP8 ", "VP8L":
+			bitstream = &chunks[i]
+		}
+	}
+	if bitstream == nil {
+		return animationFrame{}, MalformedAnimationError
+	}
+
+	var still bytes.Buffer
+	if alpha != nil && bitstream.id == "VP8 " {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x10 // has alpha
+		vp8x[4], vp8x[5], vp8x[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+		writeRIFFChunk(&still, "VP8X", vp8x)
+		writeRIFFChunk(&still, "ALPH", alpha.data)
+	}
+	writeRIFFChunk(&still, bitstream.id, bitstream.data)
+	riff := make([]byte, 12, 12+still.Len())
+	copy(riff, "RIFF")
+	binary.LittleEndian.PutUint32(riff[4:], uint32(4+still.Len()))
+	copy(riff[8:], "WEBP")
+	riff = append(riff, still.Bytes()...)
+	config, err := webp.DecodeConfig(bytes.NewReader(riff))
+	if err != nil {
+		return animationFrame{}, err
+	}
+	if config.Width != width || config.Height != height {
+		return animationFrame{}, MalformedAnimationError
+	}
+	frame.img, err = webp.Decode(bytes.NewReader(riff))
+	if err != nil {
+		return animationFrame{}, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+// The WebPs in testdata come from golang.org/x/image's test images.
+// animated.webp puts the bitstreams of the other two, and of
+// blue-purple-pink.lossy.webp, into a three frame animation, and
+// animated.png is a three frame APNG whose frames are solid red, blue and
+// green.
+
+func readTestdata(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+type testChunk struct {
+	kind string
+	data []byte
+}
+
+func splitPNG(t *testing.T, data []byte) []testChunk {
+	var chunks []testChunk
+	data = data[len(pngSignature):]
+	for len(data) >= 12 {
+		n := int(binary.BigEndian.Uint32(data))
+		chunks = append(chunks, testChunk{string(data[4:8]), append([]byte{}, data[8:8+n]...)})
+		data = data[12+n:]
+	}
+	return chunks
+}
+
+func joinPNG(chunks []testChunk) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	for _, c := range chunks {
+		writePNGChunk(&buf, c.kind, c.data)
+	}
+	return buf.Bytes()
+}
+
+func splitWebP(t *testing.T, data []byte) []testChunk {
+	chunks, err := riffChunks(data[12:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []testChunk
+	for _, c := range chunks {
+		out = append(out, testChunk{c.id, append([]byte{}, c.data...)})
+	}
+	return out
+}
+
+func joinWebP(chunks []testChunk) []byte {
+	var body bytes.Buffer
+	for _, c := range chunks {
+		writeRIFFChunk(&body, c.kind, c.data)
+	}
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	binary.LittleEndian.PutUint32(out[4:], uint32(4+body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+// editChunk returns a copy of chunks with fn applied to the nth chunk of
+// the given kind.
+func editChunk(chunks []testChunk, kind string, n int, fn func(c *testChunk)) []testChunk {
+	out := make([]testChunk, len(chunks))
+	for i, c := range chunks {
+		out[i] = testChunk{c.kind, append([]byte{}, c.data...)}
+	}
+	for i := range out {
+		if out[i].kind != kind {
+			continue
+		}
+		if n == 0 {
+			fn(&out[i])
+			break
+		}
+		n--
+	}
+	return out
+}
+
+func stillPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 5, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadAnimationHeader(t *testing.T) {
+	apng := readTestdata(t, "animated.png")
+	// chunks the decoder doesn't care about can come before acTL
+	var text bytes.Buffer
+	text.WriteString(pngSignature)
+	chunks := splitPNG(t, apng)
+	writePNGChunk(&text, chunks[0].kind, chunks[0].data)
+	writePNGChunk(&text, "tEXt", bytes.Repeat([]byte("x"), 4096))
+	text.Write(joinPNG(chunks[1:])[len(pngSignature):])
+
+	cases := []struct {
+		name        string
+		contentType string
+		data        []byte
+		animated    bool
+	}{
+		{"apng", "image/png", apng, true},
+		{"apng with text", "image/png", text.Bytes(), true},
+		{"png", "image/png", stillPNG(t), false},
+		{"truncated apng", "image/png", apng[:20], false},
+		{"animated webp", "image/webp", readTestdata(t, "animated.webp"), true},
+		{"webp", "image/webp", readTestdata(t, "yellow_rose.lossy-with-alpha.webp"), false},
+		{"truncated webp", "image/webp", []byte("RIFF"), false},
+		{"empty", "image/png", nil, false},
+	}
+	for _, tc := range cases {
+		header, animated, err := readAnimationHeader(tc.contentType, bytes.NewReader(tc.data))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+			continue
+		}
+		if animated != tc.animated {
+			t.Errorf("%s: expected animated to be %v", tc.name, tc.animated)
+		}
+		// nothing is lost when the rest of the upload follows the header
+		if !bytes.HasPrefix(tc.data, header) {
+			t.Errorf("%s: expected the header to be the start of the file", tc.name)
+		}
+	}
+}
+
+func TestConvertAPNG(t *testing.T) {
+	g, err := convertToGIF("image/png", readTestdata(t, "animated.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 || g.Config.Width != 8 || g.Config.Height != 8 || g.LoopCount != 1 {
+		t.Fatalf("Expected an 8x8 GIF with 3 frames that plays twice, got %dx%d with %d frames looping %d", g.Config.Width, g.Config.Height, len(g.Image), g.LoopCount)
+	}
+	expectedDelays := []int{10, 20, 5}
+	for i, delay := range g.Delay {
+		if delay != expectedDelays[i] {
+			t.Errorf("Expected delays %v, got %v", expectedDelays, g.Delay)
+			break
+		}
+	}
+	red, blue, green := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255}
+	frames := composited(t, g)
+	cases := []struct {
+		frame, x, y int
+		expected    color.RGBA
+	}{
+		{0, 3, 3, red},
+		{1, 3, 3, blue},
+		{1, 0, 0, red},
+		// the second frame is cleared away, and the third blended over it
+		{2, 3, 3, color.RGBA{}},
+		{2, 5, 5, green},
+		{2, 7, 0, red},
+	}
+	for _, tc := range cases {
+		if got := frames[tc.frame].RGBAAt(tc.x, tc.y); got != tc.expected {
+			t.Errorf("Expected frame %d to be %v at %d,%d, got %v", tc.frame, tc.expected, tc.x, tc.y, got)
+		}
+	}
+}
+
+func TestConvertWebP(t *testing.T) {
+	g, err := convertToGIF("image/webp", readTestdata(t, "animated.webp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 || g.Config.Width != 400 || g.Config.Height != 301 || g.LoopCount != 2 {
+		t.Fatalf("Expected a 400x301 GIF with 3 frames that plays 3 times, got %dx%d with %d frames looping %d", g.Config.Width, g.Config.Height, len(g.Image), g.LoopCount)
+	}
+	expectedDelays := []int{10, 25, 4}
+	for i, delay := range g.Delay {
+		if delay != expectedDelays[i] {
+			t.Errorf("Expected delays %v, got %v", expectedDelays, g.Delay)
+			break
+		}
+	}
+	expected, err := webp.Decode(bytes.NewReader(readTestdata(t, "blue-purple-pink.lossless.webp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first frame is the lossless image, down to 256 colors, with
+	// nothing around it
+	first := composited(t, g)[0]
+	var diff int
+	b := expected.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r1, g1, b1, _ := expected.At(x, y).RGBA()
+			c := first.RGBAAt(x, y)
+			diff += absDiff(r1>>8, uint32(c.R)) + absDiff(g1>>8, uint32(c.G)) + absDiff(b1>>8, uint32(c.B))
+		}
+	}
+	if avg := diff / (b.Dx() * b.Dy() * 3); avg > 24 {
+		t.Errorf("Expected the first frame to look like the image it came from, but it's off by %d on average", avg)
+	}
+	if first.RGBAAt(300, 200).A != 0 {
+		t.Error("Expected the first frame to be transparent outside the image")
+	}
+}
+
+func absDiff(a, b uint32) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func TestConvertMalformed(t *testing.T) {
+	apng := readTestdata(t, "animated.png")
+	pngChunks := splitPNG(t, apng)
+	animated := readTestdata(t, "animated.webp")
+	webpChunks := splitWebP(t, animated)
+
+	cases := []struct {
+		name        string
+		contentType string
+		data        []byte
+		err         error
+	}{
+		{"png", "image/png", stillPNG(t), CorruptImageError},
+		{"truncated apng", "image/png", apng[:len(apng)-40], CorruptImageError},
+		{"apng without a signature", "image/png", apng[8:], CorruptImageError},
+		{"apng chunk past the end", "image/png", apng[:len(apng)-14], CorruptImageError},
+		{"short acTL", "image/png", joinPNG(editChunk(pngChunks, "acTL", 0, func(c *testChunk) { c.data = c.data[:4] })), CorruptImageError},
+		{"short fcTL", "image/png", joinPNG(editChunk(pngChunks, "fcTL", 1, func(c *testChunk) { c.data = c.data[:20] })), CorruptImageError},
+		{"short fdAT", "image/png", joinPNG(editChunk(pngChunks, "fdAT", 0, func(c *testChunk) { c.data = c.data[:2] })), CorruptImageError},
+		{"fdAT before fcTL", "image/png", joinPNG(editChunk(pngChunks, "fcTL", 0, func(c *testChunk) { c.kind = "fdAT" })), CorruptImageError},
+		{"frame off the canvas", "image/png", joinPNG(editChunk(pngChunks, "fcTL", 1, func(c *testChunk) { binary.BigEndian.PutUint32(c.data[12:], 6) })), CorruptImageError},
+		{"empty frame", "image/png", joinPNG(editChunk(pngChunks, "fcTL", 1, func(c *testChunk) { binary.BigEndian.PutUint32(c.data[4:], 0) })), CorruptImageError},
+		{"corrupt frame data", "image/png", joinPNG(editChunk(pngChunks, "fdAT", 1, func(c *testChunk) { c.data = append(c.data[:4], "not zlib"...) })), CorruptImageError},
+		{"huge apng", "image/png", joinPNG(editChunk(pngChunks, "IHDR", 0, func(c *testChunk) {
+			binary.BigEndian.PutUint32(c.data[0:], 1<<14)
+			binary.BigEndian.PutUint32(c.data[4:], 1<<14)
+		})), PartTooLargeError},
+		{"apng too large to convert", "image/png", joinPNG(editChunk(pngChunks, "IHDR", 0, func(c *testChunk) {
+			binary.BigEndian.PutUint32(c.data[0:], 1<<12)
+			binary.BigEndian.PutUint32(c.data[4:], 1<<11)
+		})), PartTooLargeError},
+		{"apng wider than a gif", "image/png", joinPNG(editChunk(pngChunks, "IHDR", 0, func(c *testChunk) { binary.BigEndian.PutUint32(c.data[0:], 1<<16) })), PartTooLargeError},
+
+		{"webp", "image/webp", readTestdata(t, "yellow_rose.lossy-with-alpha.webp"), CorruptImageError},
+		{"truncated webp", "image/webp", animated[:len(animated)/2], CorruptImageError},
+		{"webp header only", "image/webp", []byte("RIFF\x10\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02"), CorruptImageError},
+		{"short ANIM", "image/webp", joinWebP(editChunk(webpChunks, "ANIM", 0, func(c *testChunk) { c.data = c.data[:4] })), CorruptImageError},
+		{"short ANMF", "image/webp", joinWebP(editChunk(webpChunks, "ANMF", 0, func(c *testChunk) { c.data = c.data[:12] })), CorruptImageError},
+		{"ANMF off the canvas", "image/webp", joinWebP(editChunk(webpChunks, "ANMF", 1, func(c *testChunk) { c.data[0] = 200 })), CorruptImageError},
+		{"ANMF without a bitstream", "image/webp", joinWebP(editChunk(webpChunks, "ANMF", 0, func(c *testChunk) { c.data = c.data[:16] })), CorruptImageError},
+		{"ANMF the wrong size", "image/webp", joinWebP(editChunk(webpChunks, "ANMF", 0, func(c *testChunk) { c.data[6]-- })), CorruptImageError},
+		{"webp without frames", "image/webp", joinWebP(webpChunks[:2]), CorruptImageError},
+		{"huge webp", "image/webp", joinWebP(editChunk(webpChunks, "VP8X", 0, func(c *testChunk) { c.data[6] = 0xff })), PartTooLargeError},
+	}
+	for _, tc := range cases {
+		_, err := convertedUpload(context.Background(), tc.contentType, tc.data)
+		if err != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestUploadConvertsAnimations(t *testing.T) {
+	storage := NewMemStorage()
+	datastore := NewMemDatastore()
+	c := Context{Storage: storage, Datastore: datastore, UsageTracker: NewUsageTracker(), Bucket: "gifs"}
+	collection, err := datastore.CreateCollection("reactions", "Reactions", "alice", VisibilityPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = Upload(context.Background(), "alice", collection, "still", ConflictReject, bytes.NewReader(stillPNG(t)), c)
+	if err != UnsupportedTypeError {
+		t.Errorf("Expected PNGs not to be allowed by default, got %v", err)
+	}
+
+	c.AllowedTypes = []string{"image/gif", "image/png", "image/webp"}
+	for _, name := range []string{"animated.png", "animated.webp"} {
+		item, info, err := Upload(context.Background(), "alice", collection, name, ConflictReject, bytes.NewReader(readTestdata(t, name)), c)
+		if err != nil {
+			t.Errorf("Error uploading %s: %s", name, err)
+			continue
+		}
+		if info.ContentType != "image/gif" || item.Frames != 3 {
+			t.Errorf("Expected %s to be converted to a GIF with 3 frames, got %s with %d", name, info.ContentType, item.Frames)
+		}
+		_, err = gif.DecodeAll(bytes.NewReader(storage.(Memstorage)["gifs"][item.Blob]))
+		if err != nil {
+			t.Errorf("Error decoding %s's blob: %s", name, err)
+		}
+	}
+	// PNGs and WebPs are only allowed to be converted
+	stored := len(storage.(Memstorage)["gifs"])
+	for i, data := range [][]byte{stillPNG(t), readTestdata(t, "yellow_rose.lossy-with-alpha.webp")} {
+		_, _, err := Upload(context.Background(), "alice", collection, "still"+strconv.Itoa(i), ConflictReject, bytes.NewReader(data), c)
+		if err != StillImageError {
+			t.Errorf("Expected %v uploading a still image, got %v", StillImageError, err)
+		}
+	}
+	if n := len(storage.(Memstorage)["gifs"]); n != stored {
+		t.Errorf("Expected still images not to be stored, got %d new blobs", n-stored)
+	}
+}
+
+func TestConvertedUploadWaitsForATurn(t *testing.T) {
+	for i := 0; i < MaxConcurrentConversions; i++ {
+		conversions <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < MaxConcurrentConversions; i++ {
+			<-conversions
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := convertedUpload(ctx, "image/png", readTestdata(t, "animated.png"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v while every conversion is taken, got %v", context.DeadlineExceeded, err)
+	}
+}
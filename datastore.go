@@ -2,30 +2,181 @@ package api
 
 import (
 	"errors"
+	"strconv"
 )
 
 var (
-	CollectionNotFoundError = errors.New("collection not found")
+	CollectionNotFoundError    = errors.New("collection not found")
+	CollectionExistsError      = errors.New("collection already exists")
+	TagExistsError             = errors.New("tag already exists")
+	AliasNotFoundError         = errors.New("alias not found")
+	InvalidConflictPolicyError = errors.New("invalid conflict policy")
+	MemberNotFoundError        = errors.New("member not found")
+	InvalidRoleError           = errors.New("invalid role")
+	InvalidVisibilityError     = errors.New("invalid visibility")
+	InvalidTagError            = errors.New("invalid tag")
+	AliasRenameError           = errors.New("aliases can't be renamed")
 )
 
 type Datastore interface {
 	Init(dbName string) error
-	CreateCollection(slug, name string) (Collection, error)
-	UpdateCollection(slug, name string) error
+	CreateCollection(slug, name, owner string, visibility Visibility) (Collection, error)
+	UpdateCollection(slug, name string, visibility Visibility) error
 	GetCollectionData(slug string) (Collection, error)
 	GetCollectionItems(slug string) (map[string]Item, error)
-	AddItemToCollection(slug string, item Item) error
+	AddItemToCollection(slug string, item Item, policy ConflictPolicy) (Item, error)
+	// AddItemToCollectionWithinQuota is AddItemToCollection, but fails with
+	// QuotaExceededError instead if storing the item would take its
+	// uploader's GetStoredBytes over quota. A quota of 0 is no limit.
+	AddItemToCollectionWithinQuota(slug string, item Item, policy ConflictPolicy, quota int64) (Item, error)
 	GetItemFromCollection(slug, tag string) (Item, error)
+	RemoveItemFromCollection(slug, tag string) error
+	// RenameItem changes an item's tag, keeping its aliases. oldTag has to
+	// be the item's tag; renaming one of its aliases fails with
+	// AliasRenameError.
+	RenameItem(slug, oldTag, newTag string) error
+	AddAliasToItem(slug, tag, alias string) error
+	RemoveAliasFromItem(slug, tag, alias string) error
+	AddMemberToCollection(slug, user string, role Role) error
+	GetMemberFromCollection(slug, user string) (Role, error)
+	GetCollectionMembers(slug string) (map[string]Role, error)
+	RemoveMemberFromCollection(slug, user string) error
+	// CountBlobReferences returns how many items, in any collection, use
+	// blob as their blob or as their original.
+	CountBlobReferences(bucket, blob string) (int, error)
+	// GetStoredBytes adds up the Size of every item user uploaded that's
+	// still in a collection.
+	GetStoredBytes(user string) (int64, error)
 }
 
 type Collection struct {
-	Items map[string]Item
-	Name  string
-	Slug  string
+	Items      map[string]Item
+	Members    map[string]Role
+	Name       string
+	Slug       string
+	Owner      string
+	Visibility Visibility
 }
 
+// Visibility controls who can read a collection without being a member.
+// Public collections can be listed and downloaded by anyone, unlisted
+// collections can only be downloaded by anyone who knows an item's tag,
+// and private collections can only be read by their members.
+type Visibility string
+
+const (
+	VisibilityPublic   Visibility = "public"
+	VisibilityUnlisted Visibility = "unlisted"
+	VisibilityPrivate  Visibility = "private"
+)
+
+func (v Visibility) Valid() bool {
+	return v == VisibilityPublic || v == VisibilityUnlisted || v == VisibilityPrivate
+}
+
+// Collections that were created before visibility existed don't have one,
+// and were always public.
+func (v Visibility) normalize() (Visibility, error) {
+	if v == "" {
+		return VisibilityPublic, nil
+	}
+	if !v.Valid() {
+		return v, InvalidVisibilityError
+	}
+	return v, nil
+}
+
+func (c Collection) listable() bool {
+	return c.Visibility == VisibilityPublic || c.Visibility == ""
+}
+
+func (c Collection) downloadable() bool {
+	return c.Visibility != VisibilityPrivate
+}
+
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && other.Valid() && roleRanks[r] >= roleRanks[other]
+}
+
+// Item is a blob stored in a collection under Tag. An item can also be
+// found by any of its Aliases, and every method that takes a tag accepts
+// an alias in its place.
 type Item struct {
-	Blob   string
-	Bucket string
-	Tag    string
+	Blob    string
+	Bucket  string
+	Tag     string
+	Aliases []string
+	Metadata
+}
+
+// Metadata describes the blob an item points to. Everything but Size is
+// only filled in for GIFs.
+type Metadata struct {
+	Width     int
+	Height    int
+	Frames    int
+	Duration  int // total time one loop takes to play, in milliseconds
+	LoopCount int // as in image/gif: 0 loops forever, -1 plays once
+	Size      int64
+	// Size of the blob as it was uploaded. Optimized uploads are stored
+	// in fewer bytes than this.
+	OriginalSize int64
+	// Animated uploads in other formats are converted to GIFs. If the
+	// original was kept, this is its blob and type.
+	OriginalBlob string
+	OriginalType string
+	// Uploader is charged for the item's Size, for as long as the item
+	// keeps it.
+	Uploader string
+}
+
+// ConflictPolicy decides what AddItemToCollection does when an item's tag
+// is already used by another item or alias in the collection.
+type ConflictPolicy string
+
+const (
+	// ConflictReject fails with TagExistsError.
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictOverwrite points the existing item at the new blob.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictRename stores the item under the first free tag of the
+	// form tag-2, tag-3, and so on, up to tag-1000. The tag is shortened if
+	// that's what it takes to fit the suffix in MaxTagLength.
+	ConflictRename ConflictPolicy = "rename"
+)
+
+func (p ConflictPolicy) Valid() bool {
+	return p == ConflictReject || p == ConflictOverwrite || p == ConflictRename
+}
+
+// maxTagSuffix is the highest suffix ConflictRename tries before giving up
+// with TagExistsError.
+const maxTagSuffix = 1000
+
+func suffixedTag(tag string, n int) string {
+	suffix := "-" + strconv.Itoa(n)
+	runes := []rune(tag)
+	if max := MaxTagLength - len(suffix); len(runes) > max {
+		runes = runes[:max]
+	}
+	return string(runes) + suffix
 }
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCollectionVisibility(t *testing.T) {
+	cases := []struct {
+		visibility   Visibility
+		listable     bool
+		downloadable bool
+	}{
+		{"", true, true},
+		{VisibilityPublic, true, true},
+		{VisibilityUnlisted, false, true},
+		{VisibilityPrivate, false, false},
+	}
+	for _, tc := range cases {
+		c := Collection{Visibility: tc.visibility}
+		if got := c.listable(); got != tc.listable {
+			t.Errorf("Expected %q collections to be listable: %v, got %v", tc.visibility, tc.listable, got)
+		}
+		if got := c.downloadable(); got != tc.downloadable {
+			t.Errorf("Expected %q collections to be downloadable: %v, got %v", tc.visibility, tc.downloadable, got)
+		}
+	}
+}
+
+func TestSuffixedTag(t *testing.T) {
+	cases := []struct {
+		tag      string
+		n        int
+		expected string
+	}{
+		{"dance", 2, "dance-2"},
+		{strings.Repeat("a", 30), 2, strings.Repeat("a", 30) + "-2"},
+		{strings.Repeat("a", 32), 2, strings.Repeat("a", 30) + "-2"},
+		{strings.Repeat("é", 32), 10, strings.Repeat("é", 29) + "-10"},
+	}
+	for _, tc := range cases {
+		if got := suffixedTag(tc.tag, tc.n); got != tc.expected {
+			t.Errorf("Expected suffixedTag(%q, %d) to be %q, got %q", tc.tag, tc.n, tc.expected, got)
+		}
+	}
+}
+
+func TestConflictRenameGivesUp(t *testing.T) {
+	d := NewMemDatastore()
+	_, err := d.CreateCollection("reactions", "Reactions", "alice", VisibilityPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= maxTagSuffix; n++ {
+		tag := "dance"
+		if n > 1 {
+			tag = suffixedTag(tag, n)
+		}
+		_, err = d.AddItemToCollection("reactions", Item{Tag: tag, Blob: strconv.Itoa(n), Bucket: "gifs"}, ConflictReject)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = d.AddItemToCollection("reactions", Item{Tag: "dance", Blob: "last", Bucket: "gifs"}, ConflictRename)
+	if err != TagExistsError {
+		t.Errorf("Expected %v once every suffix is taken, got %v", TagExistsError, err)
+	}
+}
@@ -0,0 +1,1038 @@
+package datastoretest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"secondbit.org/gifs/api"
+)
+
+type Factory func(t *testing.T) api.Datastore
+
+var datastoreTests = []struct {
+	name string
+	test func(t *testing.T, d api.Datastore)
+}{
+	{"CreateCollection", testCreateCollection},
+	{"CreateCollectionVisibility", testCreateCollectionVisibility},
+	{"CreateCollectionInvalidVisibility", testCreateCollectionInvalidVisibility},
+	{"CreateCollectionExists", testCreateCollectionExists},
+	{"UpdateCollection", testUpdateCollection},
+	{"UpdateCollectionUnchanged", testUpdateCollectionUnchanged},
+	{"UpdateCollectionNotFound", testUpdateCollectionNotFound},
+	{"UpdateCollectionInvalidVisibility", testUpdateCollectionInvalidVisibility},
+	{"GetCollectionData", testGetCollectionData},
+	{"GetCollectionDataNotFound", testGetCollectionDataNotFound},
+	{"GetCollectionItems", testGetCollectionItems},
+	{"GetCollectionItemsEmpty", testGetCollectionItemsEmpty},
+	{"GetCollectionItemsNotFound", testGetCollectionItemsNotFound},
+	{"AddItemToCollectionNotFound", testAddItemToCollectionNotFound},
+	{"AddItemToCollectionReject", testAddItemToCollectionReject},
+	{"AddItemToCollectionOverwrite", testAddItemToCollectionOverwrite},
+	{"AddItemToCollectionRename", testAddItemToCollectionRename},
+	{"AddItemToCollectionRenameLongTag", testAddItemToCollectionRenameLongTag},
+	{"AddItemToCollectionAliasConflict", testAddItemToCollectionAliasConflict},
+	{"AddItemToCollectionInvalidPolicy", testAddItemToCollectionInvalidPolicy},
+	{"GetItemFromCollection", testGetItemFromCollection},
+	{"GetItemFromCollectionNotFound", testGetItemFromCollectionNotFound},
+	{"GetItemFromCollectionBlobNotFound", testGetItemFromCollectionBlobNotFound},
+	{"ItemsScopedToCollection", testItemsScopedToCollection},
+	{"RemoveItemFromCollection", testRemoveItemFromCollection},
+	{"RemoveItemFromCollectionNotFound", testRemoveItemFromCollectionNotFound},
+	{"RemoveItemFromCollectionBlobNotFound", testRemoveItemFromCollectionBlobNotFound},
+	{"RenameItem", testRenameItem},
+	{"RenameItemSameTag", testRenameItemSameTag},
+	{"RenameItemConflict", testRenameItemConflict},
+	{"RenameItemNotFound", testRenameItemNotFound},
+	{"RenameItemBlobNotFound", testRenameItemBlobNotFound},
+	{"RenameItemScopedToCollection", testRenameItemScopedToCollection},
+	{"AddAliasToItem", testAddAliasToItem},
+	{"AddAliasToItemTwice", testAddAliasToItemTwice},
+	{"AddAliasToItemConflict", testAddAliasToItemConflict},
+	{"AddAliasToItemNotFound", testAddAliasToItemNotFound},
+	{"GetCollectionItemsGroupsAliases", testGetCollectionItemsGroupsAliases},
+	{"RemoveAliasFromItem", testRemoveAliasFromItem},
+	{"RemoveAliasFromItemNotFound", testRemoveAliasFromItemNotFound},
+	{"RenameItemKeepsAliases", testRenameItemKeepsAliases},
+	{"RenameItemByAlias", testRenameItemByAlias},
+	{"RemoveItemByAlias", testRemoveItemByAlias},
+	{"AddMemberToCollection", testAddMemberToCollection},
+	{"AddMemberToCollectionUpdatesRole", testAddMemberToCollectionUpdatesRole},
+	{"AddMemberToCollectionInvalidRole", testAddMemberToCollectionInvalidRole},
+	{"AddMemberToCollectionNotFound", testAddMemberToCollectionNotFound},
+	{"GetMemberFromCollectionNotFound", testGetMemberFromCollectionNotFound},
+	{"GetCollectionMembers", testGetCollectionMembers},
+	{"MembersScopedToCollection", testMembersScopedToCollection},
+	{"RemoveMemberFromCollection", testRemoveMemberFromCollection},
+	{"RemoveMemberFromCollectionNotFound", testRemoveMemberFromCollectionNotFound},
+	{"CountBlobReferences", testCountBlobReferences},
+	{"GetStoredBytes", testGetStoredBytes},
+	{"AddItemToCollectionWithinQuota", testAddItemToCollectionWithinQuota},
+}
+
+func RunDatastoreTests(t *testing.T, factory Factory) {
+	for _, dt := range datastoreTests {
+		test := dt.test
+		t.Run(dt.name, func(t *testing.T) {
+			test(t, factory(t))
+		})
+	}
+}
+
+func mustCreateCollection(t *testing.T, d api.Datastore, slug, name string) {
+	_, err := d.CreateCollection(slug, name, "owner", api.VisibilityPublic)
+	if err != nil {
+		t.Fatalf("Error creating collection %s: %s", slug, err)
+	}
+}
+
+func mustAddItem(t *testing.T, d api.Datastore, slug string, item api.Item) {
+	_, err := d.AddItemToCollection(slug, item, api.ConflictReject)
+	if err != nil {
+		t.Fatalf("Error adding item %s to collection %s: %s", item.Tag, slug, err)
+	}
+}
+
+func testCreateCollection(t *testing.T, d api.Datastore) {
+	c, err := d.CreateCollection("reactions", "Reactions", "paddy", "")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	if c.Slug != "reactions" {
+		t.Errorf("Expected slug %q, got %q", "reactions", c.Slug)
+	}
+	if c.Name != "Reactions" {
+		t.Errorf("Expected name %q, got %q", "Reactions", c.Name)
+	}
+	if c.Owner != "paddy" {
+		t.Errorf("Expected owner %q, got %q", "paddy", c.Owner)
+	}
+	if c.Visibility != api.VisibilityPublic {
+		t.Errorf("Expected collections to default to %q, got %q", api.VisibilityPublic, c.Visibility)
+	}
+	if c.Items == nil || len(c.Items) != 0 {
+		t.Errorf("Expected empty, non-nil items, got %+v", c.Items)
+	}
+}
+
+func testCreateCollectionVisibility(t *testing.T, d api.Datastore) {
+	_, err := d.CreateCollection("reactions", "Reactions", "owner", api.VisibilityPrivate)
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	c, err := d.GetCollectionData("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	if c.Visibility != api.VisibilityPrivate {
+		t.Errorf("Expected visibility %q, got %q", api.VisibilityPrivate, c.Visibility)
+	}
+}
+
+func testCreateCollectionInvalidVisibility(t *testing.T, d api.Datastore) {
+	_, err := d.CreateCollection("reactions", "Reactions", "owner", api.Visibility("secret"))
+	if err != api.InvalidVisibilityError {
+		t.Fatalf("Expected %v, got %v", api.InvalidVisibilityError, err)
+	}
+	_, err = d.GetCollectionData("reactions")
+	if err != api.CollectionNotFoundError {
+		t.Errorf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testCreateCollectionExists(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	_, err := d.CreateCollection("reactions", "Other Reactions", "someone-else", api.VisibilityPrivate)
+	if err != api.CollectionExistsError {
+		t.Fatalf("Expected %v, got %v", api.CollectionExistsError, err)
+	}
+	c, err := d.GetCollectionData("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	if c.Name != "Reactions" {
+		t.Errorf("Expected name %q to be kept, got %q", "Reactions", c.Name)
+	}
+	if c.Owner != "owner" {
+		t.Errorf("Expected owner %q to be kept, got %q", "owner", c.Owner)
+	}
+	if c.Visibility != api.VisibilityPublic {
+		t.Errorf("Expected visibility %q to be kept, got %q", api.VisibilityPublic, c.Visibility)
+	}
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if _, ok := items["shipit"]; !ok {
+		t.Errorf("Expected existing items to be kept, got %+v", items)
+	}
+}
+
+func testUpdateCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err := d.UpdateCollection("reactions", "Team Reactions", api.VisibilityUnlisted)
+	if err != nil {
+		t.Fatalf("Error updating collection: %s", err)
+	}
+	c, err := d.GetCollectionData("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	if c.Name != "Team Reactions" {
+		t.Errorf("Expected name %q, got %q", "Team Reactions", c.Name)
+	}
+	if c.Visibility != api.VisibilityUnlisted {
+		t.Errorf("Expected visibility %q, got %q", api.VisibilityUnlisted, c.Visibility)
+	}
+	if c.Owner != "owner" {
+		t.Errorf("Expected owner %q to be kept, got %q", "owner", c.Owner)
+	}
+}
+
+func testUpdateCollectionUnchanged(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err := d.UpdateCollection("reactions", "Reactions", api.VisibilityPublic)
+	if err != nil {
+		t.Fatalf("Error updating collection with its current name: %s", err)
+	}
+}
+
+func testUpdateCollectionNotFound(t *testing.T, d api.Datastore) {
+	err := d.UpdateCollection("missing", "Missing", api.VisibilityPublic)
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testUpdateCollectionInvalidVisibility(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err := d.UpdateCollection("reactions", "Team Reactions", api.Visibility("secret"))
+	if err != api.InvalidVisibilityError {
+		t.Fatalf("Expected %v, got %v", api.InvalidVisibilityError, err)
+	}
+	c, err := d.GetCollectionData("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	if c.Name != "Reactions" || c.Visibility != api.VisibilityPublic {
+		t.Errorf("Expected collection to be unchanged, got %+v", c)
+	}
+}
+
+func testGetCollectionData(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	c, err := d.GetCollectionData("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection: %s", err)
+	}
+	if c.Slug != "reactions" || c.Name != "Reactions" || c.Owner != "owner" {
+		t.Errorf("Expected reactions/Reactions/owner, got %s/%s/%s", c.Slug, c.Name, c.Owner)
+	}
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if len(items) != 1 {
+		t.Errorf("Expected GetCollectionData to leave items alone, got %+v", items)
+	}
+}
+
+func testGetCollectionDataNotFound(t *testing.T, d api.Datastore) {
+	_, err := d.GetCollectionData("missing")
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testGetCollectionItems(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	expected := map[string]api.Item{
+		"shipit":   {Tag: "shipit", Blob: "abc123", Bucket: "gifs", Aliases: []string{}, Metadata: api.Metadata{Width: 320, Height: 240, Frames: 12, Duration: 1200, LoopCount: 0, Size: 48213, OriginalSize: 60120, OriginalBlob: "fedcba", OriginalType: "image/png"}},
+		"facepalm": {Tag: "facepalm", Blob: "def456", Bucket: "gifs", Aliases: []string{}},
+	}
+	for _, item := range expected {
+		mustAddItem(t, d, "reactions", item)
+	}
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, items)
+	}
+}
+
+func testGetCollectionItemsEmpty(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Expected no items, got %+v", items)
+	}
+}
+
+func testGetCollectionItemsNotFound(t *testing.T, d api.Datastore) {
+	_, err := d.GetCollectionItems("missing")
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testAddItemToCollectionNotFound(t *testing.T, d api.Datastore) {
+	_, err := d.AddItemToCollection("missing", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"}, api.ConflictReject)
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testAddItemToCollectionReject(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	_, err := d.AddItemToCollection("reactions", api.Item{Tag: "shipit", Blob: "def456", Bucket: "gifs"}, api.ConflictReject)
+	if err != api.TagExistsError {
+		t.Fatalf("Expected %v, got %v", api.TagExistsError, err)
+	}
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if len(items) != 1 || items["shipit"].Blob != "abc123" {
+		t.Errorf("Expected the original item to be kept, got %+v", items)
+	}
+}
+
+func testAddItemToCollectionOverwrite(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs", Metadata: api.Metadata{Width: 10, Height: 10, Frames: 1, Size: 100}})
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	metadata := api.Metadata{Width: 20, Height: 30, Frames: 4, Duration: 400, LoopCount: -1, Size: 2000, OriginalSize: 2500, OriginalBlob: "0a1b2c", OriginalType: "image/webp"}
+	item, err := d.AddItemToCollection("reactions", api.Item{Tag: "shipit", Blob: "def456", Bucket: "other", Metadata: metadata}, api.ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("Error overwriting item: %s", err)
+	}
+	expected := api.Item{Tag: "shipit", Blob: "def456", Bucket: "other", Aliases: []string{"launch"}, Metadata: metadata}
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, item)
+	}
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if !reflect.DeepEqual(items, map[string]api.Item{"shipit": expected}) {
+		t.Errorf("Expected a single overwritten item, got %+v", items)
+	}
+	item, err = d.AddItemToCollection("reactions", api.Item{Tag: "new", Blob: "ghi789", Bucket: "gifs"}, api.ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("Error adding item: %s", err)
+	}
+	if item.Tag != "new" {
+		t.Errorf("Expected tag %q, got %q", "new", item.Tag)
+	}
+}
+
+func testAddItemToCollectionRename(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "dance", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "other", Blob: "def456", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "other", "dance-2")
+	item, err := d.AddItemToCollection("reactions", api.Item{Tag: "dance", Blob: "ghi789", Bucket: "gifs"}, api.ConflictRename)
+	if err != nil {
+		t.Fatalf("Error adding item: %s", err)
+	}
+	if item.Tag != "dance-3" {
+		t.Errorf("Expected tag %q, got %q", "dance-3", item.Tag)
+	}
+	stored, err := d.GetItemFromCollection("reactions", "dance-3")
+	if err != nil {
+		t.Fatalf("Error getting item: %s", err)
+	}
+	if stored.Blob != "ghi789" {
+		t.Errorf("Expected blob %q, got %q", "ghi789", stored.Blob)
+	}
+	original, err := d.GetItemFromCollection("reactions", "dance")
+	if err != nil || original.Blob != "abc123" {
+		t.Errorf("Expected the original item to be kept, got %+v, %v", original, err)
+	}
+	item, err = d.AddItemToCollection("reactions", api.Item{Tag: "fresh", Blob: "jkl012", Bucket: "gifs"}, api.ConflictRename)
+	if err != nil {
+		t.Fatalf("Error adding item: %s", err)
+	}
+	if item.Tag != "fresh" {
+		t.Errorf("Expected an unused tag to be kept, got %q", item.Tag)
+	}
+}
+
+func testAddItemToCollectionRenameLongTag(t *testing.T, d api.Datastore) {
+	tag := strings.Repeat("é", api.MaxTagLength)
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: tag, Blob: "abc123", Bucket: "gifs"})
+	item, err := d.AddItemToCollection("reactions", api.Item{Tag: tag, Blob: "def456", Bucket: "gifs"}, api.ConflictRename)
+	if err != nil {
+		t.Fatalf("Error adding item: %s", err)
+	}
+	expected := strings.Repeat("é", api.MaxTagLength-2) + "-2"
+	if item.Tag != expected {
+		t.Errorf("Expected tag %q, got %q", expected, item.Tag)
+	}
+	_, err = d.GetItemFromCollection("reactions", expected)
+	if err != nil {
+		t.Errorf("Error getting item: %s", err)
+	}
+}
+
+func testAddItemToCollectionAliasConflict(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	_, err := d.AddItemToCollection("reactions", api.Item{Tag: "launch", Blob: "def456", Bucket: "gifs"}, api.ConflictReject)
+	if err != api.TagExistsError {
+		t.Fatalf("Expected %v, got %v", api.TagExistsError, err)
+	}
+	item, err := d.AddItemToCollection("reactions", api.Item{Tag: "launch", Blob: "def456", Bucket: "gifs"}, api.ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("Error overwriting item by alias: %s", err)
+	}
+	if item.Tag != "shipit" || item.Blob != "def456" {
+		t.Errorf("Expected the aliased item to be overwritten, got %+v", item)
+	}
+}
+
+func testAddItemToCollectionInvalidPolicy(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	_, err := d.AddItemToCollection("reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"}, api.ConflictPolicy("ignore"))
+	if err != api.InvalidConflictPolicyError {
+		t.Fatalf("Expected %v, got %v", api.InvalidConflictPolicyError, err)
+	}
+	_, err = d.GetItemFromCollection("reactions", "shipit")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
+
+func testGetItemFromCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	expected := api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs", Aliases: []string{}, Metadata: api.Metadata{Width: 500, Height: 281, Frames: 40, Duration: 3200, LoopCount: 3, Size: 1048576}}
+	mustAddItem(t, d, "reactions", expected)
+	item, err := d.GetItemFromCollection("reactions", "shipit")
+	if err != nil {
+		t.Fatalf("Error getting item: %s", err)
+	}
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, item)
+	}
+}
+
+func testGetItemFromCollectionNotFound(t *testing.T, d api.Datastore) {
+	_, err := d.GetItemFromCollection("missing", "shipit")
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testGetItemFromCollectionBlobNotFound(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	_, err := d.GetItemFromCollection("reactions", "shipit")
+	if err != api.BlobNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
+
+func testItemsScopedToCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustCreateCollection(t, d, "animals", "Animals")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	_, err := d.GetItemFromCollection("animals", "shipit")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+	items, err := d.GetCollectionItems("animals")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Expected no items in animals, got %+v", items)
+	}
+}
+
+func testRemoveItemFromCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "facepalm", Blob: "def456", Bucket: "gifs"})
+	err := d.RemoveItemFromCollection("reactions", "shipit")
+	if err != nil {
+		t.Fatalf("Error removing item: %s", err)
+	}
+	_, err = d.GetItemFromCollection("reactions", "shipit")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if _, ok := items["facepalm"]; !ok || len(items) != 1 {
+		t.Errorf("Expected only facepalm to remain, got %+v", items)
+	}
+}
+
+func testRemoveItemFromCollectionNotFound(t *testing.T, d api.Datastore) {
+	err := d.RemoveItemFromCollection("missing", "shipit")
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testRemoveItemFromCollectionBlobNotFound(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err := d.RemoveItemFromCollection("reactions", "shipit")
+	if err != api.BlobNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
+
+func testRenameItem(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	err := d.RenameItem("reactions", "shipit", "ship-it")
+	if err != nil {
+		t.Fatalf("Error renaming item: %s", err)
+	}
+	_, err = d.GetItemFromCollection("reactions", "shipit")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+	item, err := d.GetItemFromCollection("reactions", "ship-it")
+	if err != nil {
+		t.Fatalf("Error getting renamed item: %s", err)
+	}
+	expected := api.Item{Tag: "ship-it", Blob: "abc123", Bucket: "gifs", Aliases: []string{}}
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, item)
+	}
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	if !reflect.DeepEqual(items, map[string]api.Item{"ship-it": expected}) {
+		t.Errorf("Expected only the renamed item, got %+v", items)
+	}
+}
+
+func testRenameItemSameTag(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	err := d.RenameItem("reactions", "shipit", "shipit")
+	if err != nil {
+		t.Fatalf("Error renaming item to its own tag: %s", err)
+	}
+	if _, err := d.GetItemFromCollection("reactions", "shipit"); err != nil {
+		t.Errorf("Error getting item: %s", err)
+	}
+}
+
+func testRenameItemConflict(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "facepalm", Blob: "def456", Bucket: "gifs"})
+	err := d.RenameItem("reactions", "shipit", "facepalm")
+	if err != api.TagExistsError {
+		t.Fatalf("Expected %v, got %v", api.TagExistsError, err)
+	}
+	item, err := d.GetItemFromCollection("reactions", "facepalm")
+	if err != nil {
+		t.Fatalf("Error getting item: %s", err)
+	}
+	if item.Blob != "def456" {
+		t.Errorf("Expected facepalm to keep blob %q, got %q", "def456", item.Blob)
+	}
+	if _, err := d.GetItemFromCollection("reactions", "shipit"); err != nil {
+		t.Errorf("Expected shipit to be kept, got %v", err)
+	}
+}
+
+func testRenameItemNotFound(t *testing.T, d api.Datastore) {
+	err := d.RenameItem("missing", "shipit", "ship-it")
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testRenameItemBlobNotFound(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err := d.RenameItem("reactions", "shipit", "ship-it")
+	if err != api.BlobNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
+
+func testRenameItemScopedToCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustCreateCollection(t, d, "animals", "Animals")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "animals", api.Item{Tag: "shipit", Blob: "def456", Bucket: "gifs"})
+	mustAddItem(t, d, "animals", api.Item{Tag: "ship-it", Blob: "ghi789", Bucket: "gifs"})
+	err := d.RenameItem("reactions", "shipit", "ship-it")
+	if err != nil {
+		t.Fatalf("Error renaming item: %s", err)
+	}
+	item, err := d.GetItemFromCollection("animals", "shipit")
+	if err != nil || item.Blob != "def456" {
+		t.Errorf("Expected animals/shipit to be untouched, got %+v, %v", item, err)
+	}
+}
+
+func mustAddAlias(t *testing.T, d api.Datastore, slug, tag, alias string) {
+	err := d.AddAliasToItem(slug, tag, alias)
+	if err != nil {
+		t.Fatalf("Error adding alias %s to %s in collection %s: %s", alias, tag, slug, err)
+	}
+}
+
+func testAddAliasToItem(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "ship-it")
+	mustAddAlias(t, d, "reactions", "ship-it", "launch")
+	expected := api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs", Aliases: []string{"launch", "ship-it"}}
+	for _, tag := range []string{"shipit", "ship-it", "launch"} {
+		item, err := d.GetItemFromCollection("reactions", tag)
+		if err != nil {
+			t.Fatalf("Error getting item by %s: %s", tag, err)
+		}
+		if !reflect.DeepEqual(item, expected) {
+			t.Errorf("Expected %+v for %s, got %+v", expected, tag, item)
+		}
+	}
+}
+
+func testAddAliasToItemTwice(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	item, err := d.GetItemFromCollection("reactions", "shipit")
+	if err != nil {
+		t.Fatalf("Error getting item: %s", err)
+	}
+	if !reflect.DeepEqual(item.Aliases, []string{"launch"}) {
+		t.Errorf("Expected a single alias, got %+v", item.Aliases)
+	}
+}
+
+func testAddAliasToItemConflict(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "facepalm", Blob: "def456", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "facepalm", "smh")
+	for _, alias := range []string{"shipit", "facepalm", "smh"} {
+		err := d.AddAliasToItem("reactions", "shipit", alias)
+		if err != api.TagExistsError {
+			t.Errorf("Expected %v for %s, got %v", api.TagExistsError, alias, err)
+		}
+	}
+	item, err := d.GetItemFromCollection("reactions", "smh")
+	if err != nil {
+		t.Fatalf("Error getting item: %s", err)
+	}
+	if item.Tag != "facepalm" {
+		t.Errorf("Expected smh to still point at facepalm, got %s", item.Tag)
+	}
+}
+
+func testAddAliasToItemNotFound(t *testing.T, d api.Datastore) {
+	err := d.AddAliasToItem("missing", "shipit", "launch")
+	if err != api.CollectionNotFoundError {
+		t.Errorf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err = d.AddAliasToItem("reactions", "shipit", "launch")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
+
+func testGetCollectionItemsGroupsAliases(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "facepalm", Blob: "def456", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "ship-it")
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	items, err := d.GetCollectionItems("reactions")
+	if err != nil {
+		t.Fatalf("Error getting collection items: %s", err)
+	}
+	expected := map[string]api.Item{
+		"shipit":   {Tag: "shipit", Blob: "abc123", Bucket: "gifs", Aliases: []string{"launch", "ship-it"}},
+		"facepalm": {Tag: "facepalm", Blob: "def456", Bucket: "gifs", Aliases: []string{}},
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, items)
+	}
+}
+
+func testRemoveAliasFromItem(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "ship-it")
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	err := d.RemoveAliasFromItem("reactions", "launch", "ship-it")
+	if err != nil {
+		t.Fatalf("Error removing alias: %s", err)
+	}
+	_, err = d.GetItemFromCollection("reactions", "ship-it")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+	item, err := d.GetItemFromCollection("reactions", "shipit")
+	if err != nil {
+		t.Fatalf("Error getting item: %s", err)
+	}
+	if !reflect.DeepEqual(item.Aliases, []string{"launch"}) {
+		t.Errorf("Expected only launch to remain, got %+v", item.Aliases)
+	}
+}
+
+func testRemoveAliasFromItemNotFound(t *testing.T, d api.Datastore) {
+	err := d.RemoveAliasFromItem("missing", "shipit", "launch")
+	if err != api.CollectionNotFoundError {
+		t.Errorf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err = d.RemoveAliasFromItem("reactions", "shipit", "launch")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "facepalm", Blob: "def456", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "facepalm", "smh")
+	err = d.RemoveAliasFromItem("reactions", "shipit", "smh")
+	if err != api.AliasNotFoundError {
+		t.Errorf("Expected %v, got %v", api.AliasNotFoundError, err)
+	}
+	if _, err := d.GetItemFromCollection("reactions", "smh"); err != nil {
+		t.Errorf("Expected another item's alias to be kept, got %v", err)
+	}
+}
+
+func testRenameItemKeepsAliases(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	err := d.RenameItem("reactions", "shipit", "ship-it")
+	if err != nil {
+		t.Fatalf("Error renaming item: %s", err)
+	}
+	item, err := d.GetItemFromCollection("reactions", "launch")
+	if err != nil {
+		t.Fatalf("Error getting item by alias: %s", err)
+	}
+	if item.Tag != "ship-it" || !reflect.DeepEqual(item.Aliases, []string{"launch"}) {
+		t.Errorf("Expected ship-it with alias launch, got %+v", item)
+	}
+	err = d.RenameItem("reactions", "ship-it", "launch")
+	if err != api.TagExistsError {
+		t.Errorf("Expected %v, got %v", api.TagExistsError, err)
+	}
+}
+
+// Renaming an alias would have to rename the item it belongs to, which
+// isn't what was asked for, so it's refused.
+func testRenameItemByAlias(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	for _, newTag := range []string{"liftoff", "launch", "shipit"} {
+		err := d.RenameItem("reactions", "launch", newTag)
+		if err != api.AliasRenameError {
+			t.Errorf("Expected %v renaming launch to %s, got %v", api.AliasRenameError, newTag, err)
+		}
+	}
+	item, err := d.GetItemFromCollection("reactions", "launch")
+	if err != nil {
+		t.Fatalf("Error getting item by alias: %s", err)
+	}
+	if item.Tag != "shipit" || !reflect.DeepEqual(item.Aliases, []string{"launch"}) {
+		t.Errorf("Expected shipit with alias launch, got %+v", item)
+	}
+}
+
+func testRemoveItemByAlias(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddAlias(t, d, "reactions", "shipit", "launch")
+	err := d.RemoveItemFromCollection("reactions", "launch")
+	if err != nil {
+		t.Fatalf("Error removing item: %s", err)
+	}
+	for _, tag := range []string{"shipit", "launch"} {
+		_, err = d.GetItemFromCollection("reactions", tag)
+		if err != api.BlobNotFoundError {
+			t.Errorf("Expected %v for %s, got %v", api.BlobNotFoundError, tag, err)
+		}
+	}
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	item, err := d.GetItemFromCollection("reactions", "shipit")
+	if err != nil {
+		t.Fatalf("Error getting item: %s", err)
+	}
+	if len(item.Aliases) != 0 {
+		t.Errorf("Expected a re-added item not to inherit old aliases, got %+v", item.Aliases)
+	}
+}
+
+func mustAddMember(t *testing.T, d api.Datastore, slug, user string, role api.Role) {
+	err := d.AddMemberToCollection(slug, user, role)
+	if err != nil {
+		t.Fatalf("Error adding member %s to collection %s: %s", user, slug, err)
+	}
+}
+
+func testAddMemberToCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddMember(t, d, "reactions", "bob", api.RoleEditor)
+	role, err := d.GetMemberFromCollection("reactions", "bob")
+	if err != nil {
+		t.Fatalf("Error getting member: %s", err)
+	}
+	if role != api.RoleEditor {
+		t.Errorf("Expected role %q, got %q", api.RoleEditor, role)
+	}
+}
+
+func testAddMemberToCollectionUpdatesRole(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddMember(t, d, "reactions", "bob", api.RoleEditor)
+	mustAddMember(t, d, "reactions", "bob", api.RoleViewer)
+	role, err := d.GetMemberFromCollection("reactions", "bob")
+	if err != nil {
+		t.Fatalf("Error getting member: %s", err)
+	}
+	if role != api.RoleViewer {
+		t.Errorf("Expected role %q, got %q", api.RoleViewer, role)
+	}
+	members, err := d.GetCollectionMembers("reactions")
+	if err != nil {
+		t.Fatalf("Error getting members: %s", err)
+	}
+	if len(members) != 1 {
+		t.Errorf("Expected 1 member, got %+v", members)
+	}
+}
+
+func testAddMemberToCollectionInvalidRole(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err := d.AddMemberToCollection("reactions", "bob", api.Role("admin"))
+	if err != api.InvalidRoleError {
+		t.Fatalf("Expected %v, got %v", api.InvalidRoleError, err)
+	}
+	_, err = d.GetMemberFromCollection("reactions", "bob")
+	if err != api.MemberNotFoundError {
+		t.Errorf("Expected %v, got %v", api.MemberNotFoundError, err)
+	}
+}
+
+func testAddMemberToCollectionNotFound(t *testing.T, d api.Datastore) {
+	err := d.AddMemberToCollection("missing", "bob", api.RoleEditor)
+	if err != api.CollectionNotFoundError {
+		t.Fatalf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testGetMemberFromCollectionNotFound(t *testing.T, d api.Datastore) {
+	_, err := d.GetMemberFromCollection("missing", "bob")
+	if err != api.CollectionNotFoundError {
+		t.Errorf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	_, err = d.GetMemberFromCollection("reactions", "bob")
+	if err != api.MemberNotFoundError {
+		t.Errorf("Expected %v, got %v", api.MemberNotFoundError, err)
+	}
+}
+
+func testGetCollectionMembers(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	members, err := d.GetCollectionMembers("reactions")
+	if err != nil {
+		t.Fatalf("Error getting members: %s", err)
+	}
+	if len(members) != 0 {
+		t.Errorf("Expected no members, got %+v", members)
+	}
+	mustAddMember(t, d, "reactions", "bob", api.RoleEditor)
+	mustAddMember(t, d, "reactions", "carol", api.RoleViewer)
+	members, err = d.GetCollectionMembers("reactions")
+	if err != nil {
+		t.Fatalf("Error getting members: %s", err)
+	}
+	expected := map[string]api.Role{"bob": api.RoleEditor, "carol": api.RoleViewer}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, members)
+	}
+	_, err = d.GetCollectionMembers("missing")
+	if err != api.CollectionNotFoundError {
+		t.Errorf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+}
+
+func testMembersScopedToCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustCreateCollection(t, d, "cats", "Cats")
+	mustAddMember(t, d, "reactions", "bob", api.RoleEditor)
+	_, err := d.GetMemberFromCollection("cats", "bob")
+	if err != api.MemberNotFoundError {
+		t.Errorf("Expected %v, got %v", api.MemberNotFoundError, err)
+	}
+}
+
+func testRemoveMemberFromCollection(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddMember(t, d, "reactions", "bob", api.RoleEditor)
+	mustAddMember(t, d, "reactions", "carol", api.RoleViewer)
+	err := d.RemoveMemberFromCollection("reactions", "bob")
+	if err != nil {
+		t.Fatalf("Error removing member: %s", err)
+	}
+	_, err = d.GetMemberFromCollection("reactions", "bob")
+	if err != api.MemberNotFoundError {
+		t.Errorf("Expected %v, got %v", api.MemberNotFoundError, err)
+	}
+	if role, err := d.GetMemberFromCollection("reactions", "carol"); err != nil || role != api.RoleViewer {
+		t.Errorf("Expected carol to remain a viewer, got %q, %v", role, err)
+	}
+}
+
+func testRemoveMemberFromCollectionNotFound(t *testing.T, d api.Datastore) {
+	err := d.RemoveMemberFromCollection("missing", "bob")
+	if err != api.CollectionNotFoundError {
+		t.Errorf("Expected %v, got %v", api.CollectionNotFoundError, err)
+	}
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	err = d.RemoveMemberFromCollection("reactions", "bob")
+	if err != api.MemberNotFoundError {
+		t.Errorf("Expected %v, got %v", api.MemberNotFoundError, err)
+	}
+}
+
+func testCountBlobReferences(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustCreateCollection(t, d, "cats", "Cats")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "launch", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "cats", api.Item{Tag: "purr", Blob: "abc123", Bucket: "gifs"})
+	mustAddItem(t, d, "cats", api.Item{Tag: "meow", Blob: "def456", Bucket: "gifs", Metadata: api.Metadata{OriginalBlob: "abc123"}})
+	mustAddItem(t, d, "cats", api.Item{Tag: "hiss", Blob: "abc123", Bucket: "other"})
+	cases := []struct {
+		bucket, blob string
+		expected     int
+	}{
+		{"gifs", "abc123", 4},
+		{"gifs", "def456", 1},
+		{"other", "abc123", 1},
+		{"gifs", "missing", 0},
+	}
+	for _, tc := range cases {
+		n, err := d.CountBlobReferences(tc.bucket, tc.blob)
+		if err != nil {
+			t.Fatalf("Error counting references to %s in %s: %s", tc.blob, tc.bucket, err)
+		}
+		if n != tc.expected {
+			t.Errorf("Expected %d references to %s in %s, got %d", tc.expected, tc.blob, tc.bucket, n)
+		}
+	}
+	err := d.RemoveItemFromCollection("cats", "purr")
+	if err != nil {
+		t.Fatalf("Error removing item: %s", err)
+	}
+	if n, err := d.CountBlobReferences("gifs", "abc123"); err != nil || n != 3 {
+		t.Errorf("Expected 3 references after removing an item, got %d, %v", n, err)
+	}
+}
+
+func uploadedBy(user string, size int64) api.Metadata {
+	return api.Metadata{Uploader: user, Size: size}
+}
+
+func expectStoredBytes(t *testing.T, d api.Datastore, user string, expected int64) {
+	used, err := d.GetStoredBytes(user)
+	if err != nil {
+		t.Fatalf("Error getting stored bytes for %s: %s", user, err)
+	}
+	if used != expected {
+		t.Errorf("Expected %s to have %d stored bytes, got %d", user, expected, used)
+	}
+}
+
+func testGetStoredBytes(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustCreateCollection(t, d, "cats", "Cats")
+	expectStoredBytes(t, d, "paddy", 0)
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs", Metadata: uploadedBy("paddy", 10)})
+	mustAddItem(t, d, "cats", api.Item{Tag: "purr", Blob: "abc123", Bucket: "gifs", Metadata: uploadedBy("paddy", 10)})
+	mustAddItem(t, d, "cats", api.Item{Tag: "meow", Blob: "def456", Bucket: "gifs", Metadata: uploadedBy("foo", 20)})
+	// every item is charged, even when they share a blob
+	expectStoredBytes(t, d, "paddy", 20)
+	expectStoredBytes(t, d, "foo", 20)
+	_, err := d.AddItemToCollection("reactions", api.Item{Tag: "shipit", Blob: "ghi789", Bucket: "gifs", Metadata: uploadedBy("paddy", 15)}, api.ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("Error overwriting item: %s", err)
+	}
+	expectStoredBytes(t, d, "paddy", 25)
+	_, err = d.AddItemToCollection("cats", api.Item{Tag: "purr", Blob: "ghi789", Bucket: "gifs", Metadata: uploadedBy("foo", 15)}, api.ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("Error overwriting item: %s", err)
+	}
+	expectStoredBytes(t, d, "paddy", 15)
+	expectStoredBytes(t, d, "foo", 35)
+	err = d.RemoveItemFromCollection("cats", "meow")
+	if err != nil {
+		t.Fatalf("Error removing item: %s", err)
+	}
+	expectStoredBytes(t, d, "foo", 15)
+}
+
+func testAddItemToCollectionWithinQuota(t *testing.T, d api.Datastore) {
+	mustCreateCollection(t, d, "reactions", "Reactions")
+	mustAddItem(t, d, "reactions", api.Item{Tag: "shipit", Blob: "abc123", Bucket: "gifs", Metadata: uploadedBy("paddy", 10)})
+	mustAddItem(t, d, "reactions", api.Item{Tag: "dance", Blob: "def456", Bucket: "gifs", Metadata: uploadedBy("paddy", 20)})
+	_, err := d.AddItemToCollectionWithinQuota("reactions", api.Item{Tag: "wave", Blob: "ghi789", Bucket: "gifs", Metadata: uploadedBy("paddy", 15)}, api.ConflictReject, 40)
+	if err != api.QuotaExceededError {
+		t.Errorf("Expected %v, got %v", api.QuotaExceededError, err)
+	}
+	_, err = d.GetItemFromCollection("reactions", "wave")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected an item over quota not to be stored, got %v", err)
+	}
+	_, err = d.AddItemToCollectionWithinQuota("reactions", api.Item{Tag: "wave", Blob: "ghi789", Bucket: "gifs", Metadata: uploadedBy("paddy", 10)}, api.ConflictReject, 40)
+	if err != nil {
+		t.Errorf("Error adding item that fits exactly: %s", err)
+	}
+	// the item being overwritten is refunded first
+	_, err = d.AddItemToCollectionWithinQuota("reactions", api.Item{Tag: "dance", Blob: "jkl012", Bucket: "gifs", Metadata: uploadedBy("paddy", 20)}, api.ConflictOverwrite, 40)
+	if err != nil {
+		t.Errorf("Error overwriting item: %s", err)
+	}
+	_, err = d.AddItemToCollectionWithinQuota("reactions", api.Item{Tag: "dance", Blob: "mno345", Bucket: "gifs", Metadata: uploadedBy("paddy", 21)}, api.ConflictOverwrite, 40)
+	if err != api.QuotaExceededError {
+		t.Errorf("Expected %v, got %v", api.QuotaExceededError, err)
+	}
+	// but only to whoever uploaded it
+	_, err = d.AddItemToCollectionWithinQuota("reactions", api.Item{Tag: "dance", Blob: "mno345", Bucket: "gifs", Metadata: uploadedBy("foo", 20)}, api.ConflictOverwrite, 19)
+	if err != api.QuotaExceededError {
+		t.Errorf("Expected %v, got %v", api.QuotaExceededError, err)
+	}
+	_, err = d.AddItemToCollectionWithinQuota("reactions", api.Item{Tag: "dance", Blob: "mno345", Bucket: "gifs", Metadata: uploadedBy("foo", 20)}, api.ConflictOverwrite, 20)
+	if err != nil {
+		t.Errorf("Error overwriting item: %s", err)
+	}
+	item, err := d.GetItemFromCollection("reactions", "dance")
+	if err != nil || item.Blob != "mno345" || item.Uploader != "foo" {
+		t.Errorf("Expected the item to be overwritten, got %+v, %v", item, err)
+	}
+	expectStoredBytes(t, d, "paddy", 20)
+}
@@ -0,0 +1,313 @@
+package gcstest
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const apiPath = "/storage/v1beta2/"
+
+type object struct {
+	data        []byte
+	contentType string
+	generation  int64
+	acl         []acl
+}
+
+type acl struct {
+	Bucket string `json:"bucket"`
+	Entity string `json:"entity"`
+	Object string `json:"object"`
+	Role   string `json:"role"`
+}
+
+type objectResource struct {
+	Kind        string `json:"kind"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Bucket      string `json:"bucket"`
+	Generation  string `json:"generation"`
+	ContentType string `json:"contentType"`
+	Size        string `json:"size"`
+	Md5Hash     string `json:"md5Hash"`
+	Etag        string `json:"etag"`
+	MediaLink   string `json:"mediaLink"`
+	SelfLink    string `json:"selfLink"`
+}
+
+type Server struct {
+	*httptest.Server
+	buckets    map[string]map[string]*object
+	generation int64
+	sync.Mutex
+}
+
+func NewServer() *Server {
+	s := &Server{buckets: map[string]map[string]*object{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) BasePath() string {
+	return s.URL + apiPath
+}
+
+func (s *Server) Object(bucket, name string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.buckets[bucket][name]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+func (s *Server) IsPublic(bucket, name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.buckets[bucket][name]
+	if !ok {
+		return false
+	}
+	for _, a := range o.acl {
+		if a.Entity == "allUsers" && a.Role == "READER" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	path = strings.TrimPrefix(path, "/upload")
+	path = strings.TrimPrefix(path, "/download")
+	if !strings.HasPrefix(path, apiPath) {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	var parts []string
+	for _, p := range strings.Split(strings.TrimPrefix(path, apiPath), "/") {
+		p, err := url.PathUnescape(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid path")
+			return
+		}
+		parts = append(parts, p)
+	}
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case len(parts) == 3 && parts[0] == "b" && parts[2] == "o" && r.Method == "POST":
+		s.insert(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "b" && parts[2] == "o" && r.Method == "GET":
+		s.get(w, r, parts[1], parts[3])
+	case len(parts) == 4 && parts[0] == "b" && parts[2] == "o" && r.Method == "DELETE":
+		s.delete(w, r, parts[1], parts[3])
+	case len(parts) == 9 && parts[0] == "b" && parts[2] == "o" && parts[4] == "copyTo" && parts[5] == "b" && parts[7] == "o" && r.Method == "POST":
+		s.copy(w, r, parts[1], parts[3], parts[6], parts[8])
+	case len(parts) == 5 && parts[0] == "b" && parts[2] == "o" && parts[4] == "acl" && r.Method == "POST":
+		s.insertACL(w, r, parts[1], parts[3])
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *Server) insert(w http.ResponseWriter, r *http.Request, bucket string) {
+	var name, contentType string
+	var data []byte
+	var err error
+	switch r.URL.Query().Get("uploadType") {
+	case "multipart":
+		name, contentType, data, err = readMultipart(r)
+	case "media", "":
+		name = r.URL.Query().Get("name")
+		contentType = r.Header.Get("Content-Type")
+		data, err = ioutil.ReadAll(r.Body)
+	default:
+		writeError(w, http.StatusNotImplemented, "Unsupported upload type")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "Required")
+		return
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = map[string]*object{}
+	}
+	s.generation++
+	o := &object{data: data, contentType: contentType, generation: s.generation}
+	s.buckets[bucket][name] = o
+	s.writeObject(w, bucket, name, o)
+}
+
+func readMultipart(r *http.Request) (name, contentType string, data []byte, err error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	meta, err := reader.NextPart()
+	if err != nil {
+		return
+	}
+	var resource objectResource
+	err = json.NewDecoder(meta).Decode(&resource)
+	if err != nil {
+		return
+	}
+	media, err := reader.NextPart()
+	if err != nil {
+		return
+	}
+	data, err = ioutil.ReadAll(media)
+	if err != nil {
+		return
+	}
+	name = resource.Name
+	if name == "" {
+		name = r.URL.Query().Get("name")
+	}
+	contentType = resource.ContentType
+	if contentType == "" {
+		contentType = media.Header.Get("Content-Type")
+	}
+	return
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	o, ok := s.lookup(w, bucket, name)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("alt") == "media" {
+		w.Header().Set("Content-Type", o.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		w.Header().Set("ETag", etag(o))
+		w.WriteHeader(http.StatusOK)
+		w.Write(o.data)
+		return
+	}
+	s.writeObject(w, bucket, name, o)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	_, ok := s.lookup(w, bucket, name)
+	if !ok {
+		return
+	}
+	delete(s.buckets[bucket], name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, srcBucket, src, dstBucket, dst string) {
+	o, ok := s.lookup(w, srcBucket, src)
+	if !ok {
+		return
+	}
+	if _, ok := s.buckets[dstBucket]; !ok {
+		s.buckets[dstBucket] = map[string]*object{}
+	}
+	s.generation++
+	copied := &object{data: o.data, contentType: o.contentType, generation: s.generation}
+	s.buckets[dstBucket][dst] = copied
+	s.writeObject(w, dstBucket, dst, copied)
+}
+
+func (s *Server) insertACL(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	o, ok := s.lookup(w, bucket, name)
+	if !ok {
+		return
+	}
+	var a acl
+	err := json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if a.Entity == "" || a.Role == "" {
+		writeError(w, http.StatusBadRequest, "Required")
+		return
+	}
+	a.Bucket = bucket
+	a.Object = name
+	for i, existing := range o.acl {
+		if existing.Entity == a.Entity {
+			o.acl = append(o.acl[:i], o.acl[i+1:]...)
+			break
+		}
+	}
+	o.acl = append(o.acl, a)
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (s *Server) lookup(w http.ResponseWriter, bucket, name string) (*object, bool) {
+	if _, ok := s.buckets[bucket]; !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return nil, false
+	}
+	o, ok := s.buckets[bucket][name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return nil, false
+	}
+	return o, true
+}
+
+func (s *Server) writeObject(w http.ResponseWriter, bucket, name string, o *object) {
+	sum := md5.Sum(o.data)
+	link := s.BasePath() + "b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name)
+	writeJSON(w, http.StatusOK, objectResource{
+		Kind:        "storage#object",
+		ID:          bucket + "/" + name + "/" + strconv.FormatInt(o.generation, 10),
+		Name:        name,
+		Bucket:      bucket,
+		Generation:  strconv.FormatInt(o.generation, 10),
+		ContentType: o.contentType,
+		Size:        strconv.Itoa(len(o.data)),
+		Md5Hash:     base64.StdEncoding.EncodeToString(sum[:]),
+		Etag:        etag(o),
+		MediaLink:   s.URL + "/download" + apiPath + "b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name) + "?alt=media",
+		SelfLink:    link,
+	})
+}
+
+func etag(o *object) string {
+	sum := md5.Sum(o.data)
+	return fmt.Sprintf("%x", sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors": []map[string]string{
+				{"domain": "global", "reason": strings.ToLower(strings.Replace(http.StatusText(code), " ", "", -1)), "message": message},
+			},
+		},
+	})
+}
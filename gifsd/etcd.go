@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/coreos/go-etcd/etcd"
 	"secondbit.org/gifs/api"
@@ -17,22 +19,56 @@ func getEtcdContext(resp *etcd.Node) (api.Context, error) {
 	var context api.Context
 	var gcsEmail, gcsTokenURI string
 	var gcsPemBytes []byte
+	var fsRoot string
+	var s3Endpoint, s3Region, s3AccessKey, s3SecretKey string
 	var authID string
+	var signingKeys map[string][]byte
+	var signingKeyID string
+	var allowedTypes []string
+	var thumbnailSizes []int
+	var optimizeUploads, keepOriginals bool
+	var maxPartSize, maxRequestSize, userQuota int64
 	var dsn string
+	var err error
 	var bucket, domain string
 	for _, node := range resp.Nodes {
 		switch node.Key {
 		case "/gcs":
 			gcsEmail, gcsTokenURI, gcsPemBytes = gcsFromNode(node)
+		case "/s3":
+			s3Endpoint, s3Region, s3AccessKey, s3SecretKey = s3FromNode(node)
+		case "/storage":
+			fsRoot = storageFromNode(node)
 		case "/dsn":
 			dsn = node.Value
 		case "/bucket":
 			bucket = node.Value
 		case "/google_oauth2_id":
 			authID = node.Value
+		case "/signing_keys":
+			signingKeys = signingKeysFromNode(node)
+		case "/signing_key_id":
+			signingKeyID = node.Value
+		case "/allowed_types":
+			allowedTypes = allowedTypesFromValue(node.Value)
+		case "/thumbnail_sizes":
+			thumbnailSizes, err = thumbnailSizesFromValue(node.Value)
+		case "/optimize_uploads":
+			optimizeUploads, err = strconv.ParseBool(node.Value)
+		case "/keep_originals":
+			keepOriginals, err = strconv.ParseBool(node.Value)
+		case "/max_part_size":
+			maxPartSize, err = strconv.ParseInt(node.Value, 10, 64)
+		case "/max_request_size":
+			maxRequestSize, err = strconv.ParseInt(node.Value, 10, 64)
+		case "/user_quota":
+			userQuota, err = strconv.ParseInt(node.Value, 10, 64)
 		case "/domain":
 			domain = node.Value
 		}
+		if err != nil {
+			return context, errors.New("Invalid " + node.Key + ": " + err.Error())
+		}
 	}
 	if bucket == "" {
 		return context, NoBucketSetError
@@ -50,6 +86,20 @@ func getEtcdContext(resp *etcd.Node) (api.Context, error) {
 			return context, err
 		}
 		context.Storage = storage
+	} else if s3Endpoint != "" {
+		log.Println("Using S3 at " + s3Endpoint + " as our storage backend.")
+		storage, err := api.NewS3Storage(s3Endpoint, s3Region, s3AccessKey, s3SecretKey)
+		if err != nil {
+			return context, err
+		}
+		context.Storage = storage
+	} else if fsRoot != "" {
+		log.Println("Using the filesystem at " + fsRoot + " as our storage backend.")
+		storage, err := api.NewFilesystemStorage(fsRoot)
+		if err != nil {
+			return context, err
+		}
+		context.Storage = storage
 	} else {
 		context.Storage = api.NewMemStorage()
 	}
@@ -67,6 +117,15 @@ func getEtcdContext(resp *etcd.Node) (api.Context, error) {
 	context.Authorizer = api.NewGoogleOAuth2Authorizer(authID)
 	context.Bucket = bucket
 	context.RootDomain = domain
+	context.SigningKeys = signingKeys
+	context.SigningKeyID = signingKeyID
+	context.AllowedTypes = allowedTypes
+	context.ThumbnailSizes = thumbnailSizes
+	context.OptimizeUploads = optimizeUploads
+	context.KeepOriginals = keepOriginals
+	context.MaxPartSize = maxPartSize
+	context.MaxRequestSize = maxRequestSize
+	context.UserQuota = userQuota
 	return context, nil
 }
 
@@ -83,3 +142,71 @@ func gcsFromNode(node *etcd.Node) (email, token string, pem []byte) {
 	}
 	return
 }
+
+func s3FromNode(node *etcd.Node) (endpoint, region, accessKey, secretKey string) {
+	for _, n := range node.Nodes {
+		switch strings.TrimPrefix(n.Key, node.Key) {
+		case "/endpoint":
+			endpoint = n.Value
+		case "/region":
+			region = n.Value
+		case "/access_key":
+			accessKey = n.Value
+		case "/secret_key":
+			secretKey = n.Value
+		}
+	}
+	return
+}
+
+func storageFromNode(node *etcd.Node) (fsRoot string) {
+	for _, n := range node.Nodes {
+		switch strings.TrimPrefix(n.Key, node.Key) {
+		case "/fs_root":
+			fsRoot = n.Value
+		}
+	}
+	return
+}
+
+func signingKeysFromNode(node *etcd.Node) map[string][]byte {
+	keys := map[string][]byte{}
+	for _, n := range node.Nodes {
+		id := strings.TrimPrefix(strings.TrimPrefix(n.Key, node.Key), "/")
+		if id == "" || n.Value == "" {
+			continue
+		}
+		keys[id] = []byte(n.Value)
+	}
+	return keys
+}
+
+func allowedTypesFromValue(value string) []string {
+	types := []string{}
+	for _, t := range strings.Split(value, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func thumbnailSizesFromValue(value string) ([]int, error) {
+	sizes := []int{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		size, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		if size < 1 {
+			return nil, errors.New(s + " isn't a valid thumbnail size")
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
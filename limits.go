@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+)
+
+var (
+	PartTooLargeError    = errors.New("file is too large")
+	RequestTooLargeError = errors.New("request is too large")
+	QuotaExceededError   = errors.New("upload quota exceeded")
+)
+
+func isLimitError(err error) bool {
+	return err == PartTooLargeError || err == RequestTooLargeError || err == QuotaExceededError
+}
+
+// uploadLimit returns how many bytes user may upload in a single part, and
+// the error to report if they go over. replacing is the Size of the item
+// of theirs the upload is going to overwrite, if any, which they get back.
+func (c Context) uploadLimit(user string, replacing int64) (int64, error) {
+	limit, err := int64(math.MaxInt64), PartTooLargeError
+	if c.MaxPartSize > 0 {
+		limit = c.MaxPartSize
+	}
+	if c.UserQuota > 0 && c.Datastore != nil {
+		// The datastore has the final say when the upload is added to a
+		// collection; this only stops uploads that can't fit before
+		// they're stored.
+		used, storedErr := c.Datastore.GetStoredBytes(user)
+		if storedErr != nil {
+			log.Println("Error getting stored bytes: " + storedErr.Error())
+		}
+		remaining := c.UserQuota - used + replacing
+		if remaining < 0 {
+			remaining = 0
+		}
+		if remaining < limit {
+			limit, err = remaining, QuotaExceededError
+		}
+	}
+	return limit, err
+}
+
+// limitedReader fails with err as soon as more than n bytes have been read
+// from r, so oversized uploads are cut off while they're streaming instead
+// of after they've been stored. Limit errors from r are remembered too, so
+// nested limits can all be checked through the outermost reader.
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	err      error
+	exceeded error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded != nil {
+		return 0, l.exceeded
+	}
+	if int64(len(p)) > l.n {
+		// read one byte past the limit, so a file that's exactly the
+		// limit isn't rejected.
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		l.exceeded = l.err
+		return n + int(l.n), l.err
+	}
+	if isLimitError(err) {
+		l.exceeded = err
+	}
+	return n, err
+}
@@ -1,57 +1,311 @@
 package api
 
+import (
+	"sort"
+)
+
 type Memstore map[string]*Collection
 
 func (m Memstore) Init(dbName string) error {
 	return nil
 }
 
-func (m Memstore) CreateCollection(slug, name string) (Collection, error) {
+func (m Memstore) CreateCollection(slug, name, owner string, visibility Visibility) (Collection, error) {
+	visibility, err := visibility.normalize()
+	if err != nil {
+		return Collection{}, err
+	}
+	if _, ok := m[slug]; ok {
+		return Collection{}, CollectionExistsError
+	}
 	m[slug] = &Collection{Name: name,
-		Slug:  slug,
-		Items: map[string]Item{},
+		Slug:       slug,
+		Owner:      owner,
+		Visibility: visibility,
+		Items:      map[string]Item{},
+		Members:    map[string]Role{},
 	}
 	return *m[slug], nil
 }
 
-func (m Memstore) UpdateCollection(slug, name string) error {
+func (m Memstore) UpdateCollection(slug, name string, visibility Visibility) error {
+	visibility, err := visibility.normalize()
+	if err != nil {
+		return err
+	}
 	if c, ok := m[slug]; !ok {
 		return CollectionNotFoundError
 	} else {
 		c.Name = name
+		c.Visibility = visibility
 	}
 	return nil
 }
 
 func (m Memstore) GetCollectionData(slug string) (Collection, error) {
 	if c, ok := m[slug]; ok {
-		(*c).Items = nil
-		return *c, nil
+		return Collection{Name: c.Name, Slug: c.Slug, Owner: c.Owner, Visibility: c.Visibility}, nil
 	}
 	return Collection{}, CollectionNotFoundError
 }
 
+func copyItem(item Item) Item {
+	aliases := make([]string, len(item.Aliases))
+	copy(aliases, item.Aliases)
+	item.Aliases = aliases
+	return item
+}
+
+func (c *Collection) resolveTag(tag string) (string, bool) {
+	if _, ok := c.Items[tag]; ok {
+		return tag, true
+	}
+	for primary, item := range c.Items {
+		for _, alias := range item.Aliases {
+			if alias == tag {
+				return primary, true
+			}
+		}
+	}
+	return "", false
+}
+
 func (m Memstore) GetCollectionItems(slug string) (map[string]Item, error) {
 	if c, ok := m[slug]; ok {
-		return c.Items, nil
+		items := make(map[string]Item, len(c.Items))
+		for tag, item := range c.Items {
+			items[tag] = copyItem(item)
+		}
+		return items, nil
 	}
 	return map[string]Item{}, CollectionNotFoundError
 }
 
-func (m Memstore) AddItemToCollection(slug string, item Item) error {
-	if c, ok := m[slug]; ok {
-		c.Items[item.Tag] = item
-		return nil
+func (m Memstore) AddItemToCollection(slug string, item Item, policy ConflictPolicy) (Item, error) {
+	return m.AddItemToCollectionWithinQuota(slug, item, policy, 0)
+}
+
+func (m Memstore) AddItemToCollectionWithinQuota(slug string, item Item, policy ConflictPolicy, quota int64) (Item, error) {
+	if !policy.Valid() {
+		return Item{}, InvalidConflictPolicyError
+	}
+	c, ok := m[slug]
+	if !ok {
+		return Item{}, CollectionNotFoundError
+	}
+	if existing, ok := c.resolveTag(item.Tag); ok {
+		switch policy {
+		case ConflictReject:
+			return Item{}, TagExistsError
+		case ConflictOverwrite:
+			stored := c.Items[existing]
+			if !m.withinQuota(item.Metadata, stored.Metadata, quota) {
+				return Item{}, QuotaExceededError
+			}
+			stored.Blob = item.Blob
+			stored.Bucket = item.Bucket
+			stored.Metadata = item.Metadata
+			c.Items[existing] = stored
+			return copyItem(stored), nil
+		case ConflictRename:
+			tag := item.Tag
+			for n := 2; ok; n++ {
+				if n > maxTagSuffix {
+					return Item{}, TagExistsError
+				}
+				item.Tag = suffixedTag(tag, n)
+				_, ok = c.resolveTag(item.Tag)
+			}
+		}
+	}
+	if !m.withinQuota(item.Metadata, Metadata{}, quota) {
+		return Item{}, QuotaExceededError
 	}
-	return CollectionNotFoundError
+	item.Aliases = nil
+	c.Items[item.Tag] = copyItem(item)
+	return copyItem(item), nil
 }
 
 func (m Memstore) GetItemFromCollection(slug, tag string) (Item, error) {
-	if _, ok := m[slug]; !ok {
+	c, ok := m[slug]
+	if !ok {
 		return Item{}, CollectionNotFoundError
 	}
-	if _, ok := m[slug].Items[tag]; !ok {
+	tag, ok = c.resolveTag(tag)
+	if !ok {
 		return Item{}, BlobNotFoundError
 	}
-	return m[slug].Items[tag], nil
+	return copyItem(c.Items[tag]), nil
+}
+
+func (m Memstore) RemoveItemFromCollection(slug, tag string) error {
+	c, ok := m[slug]
+	if !ok {
+		return CollectionNotFoundError
+	}
+	tag, ok = c.resolveTag(tag)
+	if !ok {
+		return BlobNotFoundError
+	}
+	delete(c.Items, tag)
+	return nil
+}
+
+func (m Memstore) RenameItem(slug, oldTag, newTag string) error {
+	c, ok := m[slug]
+	if !ok {
+		return CollectionNotFoundError
+	}
+	primary, ok := c.resolveTag(oldTag)
+	if !ok {
+		return BlobNotFoundError
+	}
+	if primary != oldTag {
+		return AliasRenameError
+	}
+	if oldTag == newTag {
+		return nil
+	}
+	if _, ok := c.resolveTag(newTag); ok {
+		return TagExistsError
+	}
+	item := c.Items[primary]
+	delete(c.Items, primary)
+	item.Tag = newTag
+	c.Items[newTag] = item
+	return nil
+}
+
+func (m Memstore) AddAliasToItem(slug, tag, alias string) error {
+	c, ok := m[slug]
+	if !ok {
+		return CollectionNotFoundError
+	}
+	tag, ok = c.resolveTag(tag)
+	if !ok {
+		return BlobNotFoundError
+	}
+	if existing, ok := c.resolveTag(alias); ok {
+		if existing == tag && alias != tag {
+			return nil
+		}
+		return TagExistsError
+	}
+	item := c.Items[tag]
+	item.Aliases = append(copyItem(item).Aliases, alias)
+	sort.Strings(item.Aliases)
+	c.Items[tag] = item
+	return nil
+}
+
+func (m Memstore) RemoveAliasFromItem(slug, tag, alias string) error {
+	c, ok := m[slug]
+	if !ok {
+		return CollectionNotFoundError
+	}
+	tag, ok = c.resolveTag(tag)
+	if !ok {
+		return BlobNotFoundError
+	}
+	item := c.Items[tag]
+	aliases := []string{}
+	for _, a := range item.Aliases {
+		if a != alias {
+			aliases = append(aliases, a)
+		}
+	}
+	if len(aliases) == len(item.Aliases) {
+		return AliasNotFoundError
+	}
+	item.Aliases = aliases
+	c.Items[tag] = item
+	return nil
+}
+
+func (m Memstore) AddMemberToCollection(slug, user string, role Role) error {
+	if !role.Valid() {
+		return InvalidRoleError
+	}
+	c, ok := m[slug]
+	if !ok {
+		return CollectionNotFoundError
+	}
+	if c.Members == nil {
+		c.Members = map[string]Role{}
+	}
+	c.Members[user] = role
+	return nil
+}
+
+func (m Memstore) GetMemberFromCollection(slug, user string) (Role, error) {
+	c, ok := m[slug]
+	if !ok {
+		return "", CollectionNotFoundError
+	}
+	role, ok := c.Members[user]
+	if !ok {
+		return "", MemberNotFoundError
+	}
+	return role, nil
+}
+
+func (m Memstore) GetCollectionMembers(slug string) (map[string]Role, error) {
+	c, ok := m[slug]
+	if !ok {
+		return map[string]Role{}, CollectionNotFoundError
+	}
+	members := make(map[string]Role, len(c.Members))
+	for user, role := range c.Members {
+		members[user] = role
+	}
+	return members, nil
+}
+
+func (m Memstore) RemoveMemberFromCollection(slug, user string) error {
+	c, ok := m[slug]
+	if !ok {
+		return CollectionNotFoundError
+	}
+	if _, ok := c.Members[user]; !ok {
+		return MemberNotFoundError
+	}
+	delete(c.Members, user)
+	return nil
+}
+
+func (m Memstore) CountBlobReferences(bucket, blob string) (int, error) {
+	n := 0
+	for _, c := range m {
+		for _, item := range c.Items {
+			if item.Bucket == bucket && (item.Blob == blob || item.OriginalBlob == blob) {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// withinQuota reports whether storing an item with metadata, in place of
+// one with replaced, keeps its uploader within quota.
+func (m Memstore) withinQuota(metadata, replaced Metadata, quota int64) bool {
+	if quota <= 0 {
+		return true
+	}
+	used, _ := m.GetStoredBytes(metadata.Uploader)
+	if replaced.Uploader == metadata.Uploader {
+		used -= replaced.Size
+	}
+	return used+metadata.Size <= quota
+}
+
+func (m Memstore) GetStoredBytes(user string) (int64, error) {
+	var used int64
+	for _, c := range m {
+		for _, item := range c.Items {
+			if item.Uploader == user {
+				used += item.Size
+			}
+		}
+	}
+	return used, nil
 }
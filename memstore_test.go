@@ -0,0 +1,14 @@
+package api_test
+
+import (
+	"testing"
+
+	"secondbit.org/gifs/api"
+	"secondbit.org/gifs/api/datastoretest"
+)
+
+func TestMemstore(t *testing.T) {
+	datastoretest.RunDatastoreTests(t, func(t *testing.T) api.Datastore {
+		return api.NewMemDatastore()
+	})
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+)
+
+// optimizeGIF re-encodes g to take up less space. Each frame only covers
+// the part of the image that changed since the frame before it, pixels
+// that didn't change are left transparent, and each frame's palette only
+// has the colors that frame uses. Frames that don't change anything are
+// merged into the frame before them. It returns false for GIFs it can't
+// optimize without changing how they look, like ones whose frames add up
+// to more colors than fit in a palette once they're drawn over each other.
+func optimizeGIF(g *gif.GIF) (*gif.GIF, bool) {
+	exact := true
+	flat, err := flattenFrames(g, nil, func(canvas *image.RGBA) *image.RGBA {
+		if exact {
+			_, exact = exactPalette(canvas)
+		}
+		return canvas
+	})
+	if err != nil || !exact {
+		return nil, false
+	}
+	out := &gif.GIF{LoopCount: g.LoopCount, Config: image.Config{Width: gifBounds(g).Dx(), Height: gifBounds(g).Dy()}}
+	var previous *image.Paletted
+	for i, frame := range flat.Image {
+		if previous == nil {
+			out.Image = append(out.Image, reducePalette(frame, frame.Bounds(), nil))
+			out.Delay = append(out.Delay, flat.Delay[i])
+			out.Disposal = append(out.Disposal, gif.DisposalNone)
+			previous = frame
+			continue
+		}
+		changed, ok := changedBounds(previous, frame)
+		if !ok {
+			return nil, false
+		}
+		if changed.Empty() {
+			out.Delay[len(out.Delay)-1] += flat.Delay[i]
+			continue
+		}
+		out.Image = append(out.Image, reducePalette(frame, changed, previous))
+		out.Delay = append(out.Delay, flat.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+		previous = frame
+	}
+	return out, len(out.Image) > 0
+}
+
+// changedBounds returns the smallest rectangle holding every pixel that's
+// different in frame and previous. Frames are drawn over the frames before
+// them, so a pixel can't go back to being transparent; if one does, the
+// bool is false.
+func changedBounds(previous, frame *image.Paletted) (image.Rectangle, bool) {
+	var changed image.Rectangle
+	b := frame.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			before, after := previous.At(x, y), frame.At(x, y)
+			if before == after {
+				continue
+			}
+			if _, _, _, a := after.RGBA(); a == 0 {
+				return image.Rectangle{}, false
+			}
+			changed = changed.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	return changed, true
+}
+
+// reducePalette copies the part of frame inside r to a new image whose
+// palette only has the colors that part uses. If previous is set, pixels
+// that are the same in previous are made transparent instead.
+func reducePalette(frame *image.Paletted, r image.Rectangle, previous *image.Paletted) *image.Paletted {
+	var p color.Palette
+	indexes := map[color.Color]uint8{}
+	transparent := -1
+	out := image.NewPaletted(r, nil)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := frame.At(x, y)
+			if previous != nil && previous.At(x, y) == c {
+				if transparent < 0 {
+					transparent = len(p)
+					p = append(p, color.RGBA{})
+				}
+				out.SetColorIndex(x, y, uint8(transparent))
+				continue
+			}
+			i, ok := indexes[c]
+			if !ok {
+				// frame's own palette has at most 256 colors, and one
+				// more for transparency, so this can only overflow when
+				// frame uses all 256 colors and needs transparency too.
+				if len(p) == 256 {
+					return frame.SubImage(r).(*image.Paletted)
+				}
+				i = uint8(len(p))
+				indexes[c] = i
+				p = append(p, c)
+			}
+			out.SetColorIndex(x, y, i)
+		}
+	}
+	out.Palette = p
+	return out
+}
+
+// optimizedBlob returns g optimized and encoded, or nil if that isn't any
+// smaller than size.
+func optimizedBlob(g *gif.GIF, size int64) ([]byte, *gif.GIF) {
+	optimized, ok := optimizeGIF(g)
+	if !ok {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, optimized)
+	if err != nil || int64(buf.Len()) >= size {
+		return nil, nil
+	}
+	return buf.Bytes(), optimized
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// composited draws every frame of g the way a browser would.
+func composited(t *testing.T, g *gif.GIF) []*image.RGBA {
+	var frames []*image.RGBA
+	err := compositeFrames(g, func(i int, canvas *image.RGBA) {
+		frame := image.NewRGBA(canvas.Bounds())
+		copy(frame.Pix, canvas.Pix)
+		frames = append(frames, frame)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func TestOptimizeGIF(t *testing.T) {
+	pal := color.Palette{color.White, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	src := &gif.GIF{LoopCount: 3, Config: image.Config{Width: 64, Height: 64}}
+	// a square moving across a still background, with a pause in the
+	// middle
+	for i, x := range []int{0, 8, 8, 16, 24} {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 64), pal)
+		for j := range frame.Pix {
+			frame.Pix[j] = 2
+		}
+		for y := 20; y < 30; y++ {
+			for dx := 0; dx < 10; dx++ {
+				frame.SetColorIndex(x+dx, y, 1)
+			}
+		}
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 10+i)
+	}
+	data := encodedGIF(t, src)
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	optimized, ok := optimizeGIF(g)
+	if !ok {
+		t.Fatal("Expected the GIF to be optimized")
+	}
+	out, err := gif.DecodeAll(bytes.NewReader(encodedGIF(t, optimized)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Image) != 4 {
+		t.Fatalf("Expected the frame that doesn't change anything to be merged, got %d frames", len(out.Image))
+	}
+	expectedDelays := []int{10, 11 + 12, 13, 14}
+	for i, delay := range out.Delay {
+		if delay != expectedDelays[i] {
+			t.Errorf("Expected delays %v, got %v", expectedDelays, out.Delay)
+			break
+		}
+	}
+	if out.LoopCount != 3 || out.Config.Width != 64 || out.Config.Height != 64 {
+		t.Errorf("Expected a 64x64 GIF looping 3 times, got %dx%d looping %d", out.Config.Width, out.Config.Height, out.LoopCount)
+	}
+	for i, frame := range out.Image[1:] {
+		if frame.Bounds().Dx() >= 64 || frame.Bounds().Dy() >= 64 {
+			t.Errorf("Expected frame %d to only cover what changed, got %v", i+1, frame.Bounds())
+		}
+	}
+
+	// every frame still looks the same
+	before, after := composited(t, g), composited(t, out)
+	for i, j := range []int{0, 1, 3, 4} {
+		if !bytes.Equal(before[j].Pix, after[i].Pix) {
+			t.Errorf("Expected optimized frame %d to look like frame %d", i, j)
+		}
+	}
+	blob, _ := optimizedBlob(g, int64(len(data)))
+	if blob == nil || len(blob) >= len(data) {
+		t.Errorf("Expected the optimized GIF to be smaller than %d bytes", len(data))
+	}
+	if blob, _ := optimizedBlob(g, 1); blob != nil {
+		t.Error("Expected nothing back when optimizing doesn't save anything")
+	}
+}
+
+func TestOptimizeGIFTooManyColors(t *testing.T) {
+	// each frame has its own 200 colors, so drawn over each other they
+	// come to more than fit in a palette
+	var frames []*image.Paletted
+	for i := 0; i < 2; i++ {
+		var pal color.Palette
+		for j := 0; j < 200; j++ {
+			pal = append(pal, color.RGBA{uint8(j), uint8(i * 100), 0, 255})
+		}
+		frame := image.NewPaletted(image.Rect(0, 10*i, 20, 10*i+10), pal)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(j)
+		}
+		frames = append(frames, frame)
+	}
+	g := &gif.GIF{
+		Image:  frames,
+		Delay:  []int{10, 10},
+		Config: image.Config{Width: 20, Height: 20},
+	}
+	if _, ok := optimizeGIF(g); ok {
+		t.Error("Expected a GIF with too many colors to be left alone")
+	}
+}
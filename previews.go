@@ -0,0 +1,100 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"image/png"
+	"log"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// DefaultThumbnailSizes is used when a Context doesn't set ThumbnailSizes.
+// Each size is the longest edge of a thumbnail, in pixels.
+var DefaultThumbnailSizes = []int{200}
+
+func (c Context) thumbnailSizes() []int {
+	if len(c.ThumbnailSizes) < 1 {
+		return DefaultThumbnailSizes
+	}
+	return c.ThumbnailSizes
+}
+
+// Previews are stored next to the blob they were made from, so every item
+// pointing at a blob shares them.
+func posterName(blob string) string {
+	return blob + ".poster.png"
+}
+
+func thumbnailName(blob string, size int) string {
+	return blob + ".thumb." + strconv.Itoa(size) + ".png"
+}
+
+// posterFrame draws the first frame of g on a canvas the size of the whole
+// GIF, since frames can be smaller than the GIF they're in. GIFs bigger
+// than MaxGIFPixels fail with PartTooLargeError.
+func posterFrame(g *gif.GIF) (image.Image, error) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if int64(bounds.Dx())*int64(bounds.Dy()) > MaxGIFPixels {
+		return nil, PartTooLargeError
+	}
+	canvas := image.NewRGBA(bounds)
+	if len(g.Image) > 0 {
+		frame := g.Image[0]
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	}
+	return canvas, nil
+}
+
+// thumbnail scales img down so its longest edge is size pixels. Images
+// that are already small enough are left alone.
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w >= h {
+		w, h = size, h*size/w
+	} else {
+		w, h = w*size/h, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+func putPNG(ctx context.Context, c Context, name string, img image.Image) error {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return err
+	}
+	_, err = GetObjectStorage(c).Put(ctx, c.Bucket, name, &buf)
+	return err
+}
+
+// storePreviews saves a poster and thumbnails of poster for blob. Previews
+// are nice to have, so failures are logged instead of failing the upload.
+func storePreviews(ctx context.Context, c Context, blob string, poster image.Image) {
+	err := putPNG(ctx, c, posterName(blob), poster)
+	if err != nil {
+		log.Printf("Error storing poster for %s: %s\n", blob, err)
+		return
+	}
+	for _, size := range c.thumbnailSizes() {
+		err = putPNG(ctx, c, thumbnailName(blob, size), thumbnail(poster, size))
+		if err != nil {
+			log.Printf("Error storing %dpx thumbnail for %s: %s\n", size, blob, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func TestPosterFrame(t *testing.T) {
+	pal := color.Palette{color.Transparent, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	first := image.NewPaletted(image.Rect(2, 1, 5, 3), pal)
+	for i := range first.Pix {
+		first.Pix[i] = 1
+	}
+	second := image.NewPaletted(image.Rect(0, 0, 8, 6), pal)
+	for i := range second.Pix {
+		second.Pix[i] = 2
+	}
+	data := encodedGIF(t, &gif.GIF{
+		Image:  []*image.Paletted{first, second},
+		Delay:  []int{10, 10},
+		Config: image.Config{Width: 8, Height: 6},
+	})
+	g, err := decodeGIF(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poster, err := posterFrame(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, poster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != image.Rect(0, 0, 8, 6) {
+		t.Fatalf("Expected the poster to cover the whole GIF, got %v", decoded.Bounds())
+	}
+	// only the first frame is drawn, where it is in the GIF
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			_, _, _, a := decoded.At(x, y).RGBA()
+			inFrame := image.Pt(x, y).In(first.Bounds())
+			if r, _, _, _ := decoded.At(x, y).RGBA(); inFrame && r != 0xffff {
+				t.Errorf("Expected %d,%d to be red", x, y)
+			} else if !inFrame && a != 0 {
+				t.Errorf("Expected %d,%d to be transparent", x, y)
+			}
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	cases := []struct {
+		width, height int
+		size          int
+		expected      image.Rectangle
+	}{
+		{400, 200, 200, image.Rect(0, 0, 200, 100)},
+		{200, 400, 100, image.Rect(0, 0, 50, 100)},
+		{100, 50, 200, image.Rect(0, 0, 100, 50)},
+		{1000, 1, 10, image.Rect(0, 0, 10, 1)},
+	}
+	for _, tc := range cases {
+		img := image.NewRGBA(image.Rect(0, 0, tc.width, tc.height))
+		if got := thumbnail(img, tc.size).Bounds(); got != tc.expected {
+			t.Errorf("Expected a %dpx thumbnail of %dx%d to be %v, got %v", tc.size, tc.width, tc.height, tc.expected, got)
+		}
+	}
+}
+
+func TestStorePreviews(t *testing.T) {
+	c := Context{Storage: NewMemStorage(), Bucket: "gifs", ThumbnailSizes: []int{4, 2}}
+	storePreviews(context.Background(), c, "abc123", image.NewRGBA(image.Rect(0, 0, 8, 6)))
+	for _, name := range []string{posterName("abc123"), thumbnailName("abc123", 4), thumbnailName("abc123", 2)} {
+		data, ok := c.Storage.(Memstorage)["gifs"][name]
+		if !ok {
+			t.Errorf("Expected %s to be stored", name)
+			continue
+		}
+		_, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("Error decoding %s: %s", name, err)
+		}
+	}
+}
+
+func TestGIFsTooLargeToDraw(t *testing.T) {
+	// each frame decodes to 4096x4096 pixels, so five of them don't fit
+	_, err := decodeGIF(bytes.NewReader(framesGIF(4096, 4096, 5)))
+	if err != PartTooLargeError {
+		t.Errorf("Expected decodeGIF to fail with %v, got %v", PartTooLargeError, err)
+	}
+	// small frames are drawn at the GIF's full size too
+	pal := color.Palette{color.Black}
+	dot := image.NewPaletted(image.Rect(0, 0, 1, 1), pal)
+	g := &gif.GIF{Config: image.Config{Width: 4096, Height: 4096}}
+	for i := 0; i < 5; i++ {
+		g.Image = append(g.Image, dot)
+		g.Delay = append(g.Delay, 10)
+	}
+	_, err = decodeGIF(bytes.NewReader(encodedGIF(t, g)))
+	if err != PartTooLargeError {
+		t.Errorf("Expected decodeGIF to fail with %v, got %v", PartTooLargeError, err)
+	}
+	err = compositeFrames(g, func(int, *image.RGBA) {
+		t.Error("Expected no frames to be drawn")
+	})
+	if err != PartTooLargeError {
+		t.Errorf("Expected compositeFrames to fail with %v, got %v", PartTooLargeError, err)
+	}
+	_, err = Caption(g, "too", "big")
+	if err != PartTooLargeError {
+		t.Errorf("Expected Caption to fail with %v, got %v", PartTooLargeError, err)
+	}
+	err = encodeAPNG(&bytes.Buffer{}, g)
+	if err != PartTooLargeError {
+		t.Errorf("Expected encodeAPNG to fail with %v, got %v", PartTooLargeError, err)
+	}
+	if _, ok := optimizeGIF(g); ok {
+		t.Error("Expected optimizeGIF to give up")
+	}
+	g.Config = image.Config{Width: 65535, Height: 65535}
+	_, err = posterFrame(g)
+	if err != PartTooLargeError {
+		t.Errorf("Expected posterFrame to fail with %v, got %v", PartTooLargeError, err)
+	}
+
+	// transforms are checked against the size they make
+	g = &gif.GIF{Config: image.Config{Width: 16, Height: 16}}
+	for i := 0; i < 20; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 16, 16), pal))
+		g.Delay = append(g.Delay, 10)
+	}
+	_, err = Transform{Width: MaxTransformSize}.Apply(g)
+	if err != PartTooLargeError {
+		t.Errorf("Expected Apply to fail with %v, got %v", PartTooLargeError, err)
+	}
+	_, err = Transform{Width: 32}.Apply(g)
+	if err != nil {
+		t.Errorf("Error applying a transform that fits: %s", err)
+	}
+}
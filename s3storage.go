@@ -0,0 +1,456 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultS3Region   = "us-east-1"
+	DefaultS3PartSize = 5 * 1024 * 1024
+
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+)
+
+var (
+	InvalidS3EndpointError = errors.New("S3 endpoint must be an absolute URL")
+)
+
+type S3Storage struct {
+	Endpoint  *url.URL
+	Region    string
+	AccessKey string
+	SecretKey string
+	PartSize  int
+	Client    *http.Client
+}
+
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func (s *S3Storage) Upload(bucket, tmp string, r io.Reader, c Context, errs chan error, done chan struct{}) {
+	if errs != nil {
+		defer close(errs)
+	}
+	if done != nil {
+		defer close(done)
+	}
+	err := s.put(bucket, tmp, r)
+	if err != nil && errs != nil {
+		errs <- err
+	}
+}
+
+// Part buffers are reused across uploads. A request that fails can leave
+// the transport still reading its body, so buffers only go back to the pool
+// after a successful upload.
+var s3Buffers sync.Pool
+
+func s3Buffer(size int) *[]byte {
+	if buf, ok := s3Buffers.Get().(*[]byte); ok && cap(*buf) >= size {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+func (s *S3Storage) put(bucket, key string, r io.Reader) error {
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = DefaultS3PartSize
+	}
+	buf := s3Buffer(partSize)
+	err := s.putBuffered(bucket, key, r, *buf)
+	if err == nil {
+		s3Buffers.Put(buf)
+	}
+	return err
+}
+
+func (s *S3Storage) putBuffered(bucket, key string, r io.Reader, buf []byte) error {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do("PUT", bucket, key, nil, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.putMultipart(bucket, key, buf, r)
+}
+
+// putMultipart uploads buf, which is already full, and the rest of r as a
+// multipart upload, reading each part into buf once the one before it is
+// sent.
+func (s *S3Storage) putMultipart(bucket, key string, buf []byte, r io.Reader) error {
+	resp, err := s.do("POST", bucket, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	uploadID := initiated.UploadID
+	complete := s3CompleteMultipartUpload{}
+	part := buf
+	for partNumber := 1; ; partNumber++ {
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		resp, err := s.do("PUT", bucket, key, query, nil, part)
+		if err != nil {
+			s.abortMultipart(bucket, key, uploadID)
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			s.abortMultipart(bucket, key, uploadID)
+			return err
+		}
+		part = buf[:n]
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		s.abortMultipart(bucket, key, uploadID)
+		return err
+	}
+	resp, err = s.do("POST", bucket, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		s.abortMultipart(bucket, key, uploadID)
+		return err
+	}
+	defer resp.Body.Close()
+	return checkS3Body(resp)
+}
+
+func (s *S3Storage) abortMultipart(bucket, key, uploadID string) {
+	resp, err := s.do("DELETE", bucket, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+func (s *S3Storage) Delete(bucket, tmp string) error {
+	resp, err := s.do("DELETE", bucket, tmp, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Move(srcBucket, src, dstBucket, dst string, c Context) error {
+	resp, err := s.do("HEAD", dstBucket, dst, nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		go del(srcBucket, src, c)
+		return nil
+	}
+	if err != BlobNotFoundError && err != BucketNotFoundError {
+		return err
+	}
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/"+s3Escape(srcBucket)+"/"+s3Escape(src))
+	resp, err = s.do("PUT", dstBucket, dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = checkS3Body(resp)
+	if err != nil {
+		return err
+	}
+	go del(srcBucket, src, c)
+	return nil
+}
+
+// SetPublic makes key readable by anyone.
+func (s *S3Storage) SetPublic(bucket, key string, c Context) error {
+	header := http.Header{}
+	header.Set("x-amz-acl", "public-read")
+	resp, err := s.do("PUT", bucket, key, url.Values{"acl": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Download(bucket, id string, w io.Writer, c Context) (int64, error) {
+	resp, err := s.do("GET", bucket, id, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+func (s *S3Storage) ObjectStorage() ObjectStorage {
+	return s3Objects{s}
+}
+
+type s3Objects struct {
+	s *S3Storage
+}
+
+func s3ObjectInfo(bucket, key string, resp *http.Response) ObjectInfo {
+	return ObjectInfo{
+		Bucket:      bucket,
+		Name:        key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+}
+
+func (o s3Objects) Put(ctx context.Context, bucket, key string, r io.Reader) (ObjectInfo, error) {
+	counter := &countingReader{r: ctxReader{ctx: ctx, r: r}}
+	err := o.s.put(bucket, key, counter)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Bucket: bucket, Name: key, Size: counter.n}, nil
+}
+
+func (o s3Objects) Get(ctx context.Context, bucket, key string) (io.ReadCloser, ObjectInfo, error) {
+	resp, err := o.s.doContext(ctx, "GET", bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return resp.Body, s3ObjectInfo(bucket, key, resp), nil
+}
+
+func (o s3Objects) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	resp, err := o.s.doContext(ctx, "HEAD", bucket, key, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return s3ObjectInfo(bucket, key, resp), nil
+}
+
+func (o s3Objects) Copy(ctx context.Context, srcBucket, src, dstBucket, dst string) (ObjectInfo, error) {
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/"+s3Escape(srcBucket)+"/"+s3Escape(src))
+	resp, err := o.s.doContext(ctx, "PUT", dstBucket, dst, nil, header, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+	err = checkS3Body(resp)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return o.Stat(ctx, dstBucket, dst)
+}
+
+func (o s3Objects) Delete(ctx context.Context, bucket, key string) error {
+	resp, err := o.s.doContext(ctx, "DELETE", bucket, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// S3 can report a failed copy or multipart completion with a 200 status
+// and an error document as the body, so those responses need a second
+// look before they're treated as successful.
+func checkS3Body(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(body, s3Err) == nil && s3Err.Code != "" {
+		return s3Err
+	}
+	return nil
+}
+
+func (s *S3Storage) do(method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	return s.doContext(context.Background(), method, bucket, key, query, header, body)
+}
+
+func (s *S3Storage) doContext(ctx context.Context, method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + "/" + s3Escape(bucket) + "/" + s3Escape(key)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	xml.NewDecoder(resp.Body).Decode(s3Err)
+	if resp.StatusCode == http.StatusNotFound {
+		if s3Err.Code == "NoSuchBucket" {
+			return nil, BucketNotFoundError
+		}
+		if s3Err.Code == "NoSuchKey" || s3Err.Code == "" {
+			return nil, BlobNotFoundError
+		}
+	}
+	if s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+	}
+	return nil, s3Err
+}
+
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("x-amz-date", now.Format(s3TimeFormat))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	region := s.Region
+	if region == "" {
+		region = DefaultS3Region
+	}
+	scope := now.Format(s3DateFormat) + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3EscapeComponent(k)+"="+s3EscapeComponent(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Escape(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = s3EscapeComponent(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3EscapeComponent(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
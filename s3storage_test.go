@@ -0,0 +1,26 @@
+package api_test
+
+import (
+	"testing"
+
+	"secondbit.org/gifs/api"
+	"secondbit.org/gifs/api/s3test"
+	"secondbit.org/gifs/api/storagetest"
+)
+
+func TestS3Storage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) (api.Storage, func(string, string) bool) {
+		srv := s3test.NewServer()
+		t.Cleanup(func() {
+			if n := srv.PendingUploads(); n != 0 {
+				t.Errorf("Expected no pending multipart uploads, got %d", n)
+			}
+			srv.Close()
+		})
+		s, err := api.NewS3Storage(srv.URL, "", "access", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, srv.IsPublic
+	})
+}
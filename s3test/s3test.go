@@ -0,0 +1,284 @@
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type object struct {
+	data []byte
+	acl  string
+}
+
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int][]byte
+}
+
+type Server struct {
+	*httptest.Server
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	nextID  int
+	sync.Mutex
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type copyObjectResult struct {
+	XMLName xml.Name `xml:"CopyObjectResult"`
+	ETag    string   `xml:"ETag"`
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func NewServer() *Server {
+	s := &Server{
+		buckets: map[string]map[string]*object{},
+		uploads: map[string]*upload{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+func (s *Server) IsPublic(bucket, key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.buckets[bucket][key]
+	return ok && o.acl == "public-read"
+}
+
+func (s *Server) PendingUploads() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.uploads)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") || r.Header.Get("X-Amz-Date") == "" {
+		writeError(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Only object operations are supported")
+		return
+	}
+	bucket, key := parts[0], parts[1]
+	query := r.URL.Query()
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case r.Method == "POST" && hasParam(query, "uploads"):
+		s.initiateMultipart(w, bucket, key)
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		s.uploadPart(w, query, body)
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		s.completeMultipart(w, bucket, key, query.Get("uploadId"), body)
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT" && hasParam(query, "acl"):
+		s.putACL(w, r, bucket, key)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, bucket, key)
+	case r.Method == "PUT":
+		s.bucket(bucket)[key] = &object{data: body, acl: r.Header.Get("X-Amz-Acl")}
+		w.Header().Set("ETag", etag(body))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET" || r.Method == "HEAD":
+		s.get(w, r, bucket, key)
+	case r.Method == "DELETE":
+		if b, ok := s.buckets[bucket]; ok {
+			delete(b, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+func hasParam(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func (s *Server) bucket(name string) map[string]*object {
+	if _, ok := s.buckets[name]; !ok {
+		s.buckets[name] = map[string]*object{}
+	}
+	return s.buckets[name]
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	b, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	o, ok := b[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+	w.Header().Set("Content-Type", "binary/octet-stream")
+	w.Header().Set("ETag", etag(o.data))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		w.Write(o.data)
+	}
+}
+
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return
+	}
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return
+	}
+	src, ok := s.buckets[parts[0]][parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	s.bucket(bucket)[key] = &object{data: src.data, acl: r.Header.Get("X-Amz-Acl")}
+	writeXML(w, http.StatusOK, copyObjectResult{ETag: etag(src.data)})
+}
+
+func (s *Server) putACL(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	o.acl = r.Header.Get("X-Amz-Acl")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) initiateMultipart(w http.ResponseWriter, bucket, key string) {
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = &upload{bucket: bucket, key: key, parts: map[int][]byte{}}
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, query url.Values, body []byte) {
+	u, ok := s.uploads[query.Get("uploadId")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	n, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || n < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	u.parts[n] = body
+	w.Header().Set("ETag", etag(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeMultipart(w http.ResponseWriter, bucket, key, id string, body []byte) {
+	u, ok := s.uploads[id]
+	if !ok || u.bucket != bucket || u.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	var complete completeMultipartUpload
+	err := xml.Unmarshal(body, &complete)
+	if err != nil || len(complete.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+		return
+	}
+	sort.Slice(complete.Parts, func(i, j int) bool {
+		return complete.Parts[i].PartNumber < complete.Parts[j].PartNumber
+	})
+	var data bytes.Buffer
+	for _, part := range complete.Parts {
+		p, ok := u.parts[part.PartNumber]
+		if !ok || etag(p) != part.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+			return
+		}
+		data.Write(p)
+	}
+	delete(s.uploads, id)
+	s.bucket(bucket)[key] = &object{data: data.Bytes()}
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{Bucket: bucket, Key: key, ETag: etag(data.Bytes())})
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+func writeXML(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, s3Code, message string) {
+	writeXML(w, code, errorResponse{Code: s3Code, Message: message})
+}
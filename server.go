@@ -1,12 +1,17 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"image/gif"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 )
@@ -26,18 +31,44 @@ func GetDomainMuxer(c Context) *mux.Router {
 		domainSuffix = domainSuffix[1:]
 	}
 	r.HandleFunc("/", timeHandler(wrap(c, authWrapper(UploadHandler)))).Methods("POST").Host("{collection}." + domainSuffix)
+	r.HandleFunc("/", timeHandler(wrap(c, authWrapper(UpdateCollection)))).Methods("PUT").Host("{collection}." + domainSuffix)
 	r.HandleFunc("/", timeHandler(wrap(c, authWrapper(CreateCollection)))).Methods("POST").Host(domainSuffix)
-	r.Handle("/", timeHandler(wrap(c, CollectionList))).Methods("GET").Host("{collection}." + domainSuffix)
-	r.Handle("/{id}", timeHandler(wrap(c, GetBlob))).Methods("GET").Host("{collection}." + domainSuffix)
+	r.Handle("/", timeHandler(wrap(c, optionalAuthWrapper(CollectionList)))).Methods("GET").Host("{collection}." + domainSuffix)
+	r.Handle("/_members", timeHandler(wrap(c, authWrapper(CollectionMembers)))).Methods("GET").Host("{collection}." + domainSuffix)
+	r.Handle("/_members/{user}", timeHandler(wrap(c, authWrapper(AddCollectionMember)))).Methods("PUT").Host("{collection}." + domainSuffix)
+	r.Handle("/_members/{user}", timeHandler(wrap(c, authWrapper(RemoveCollectionMember)))).Methods("DELETE").Host("{collection}." + domainSuffix)
+	r.Handle("/_sign/{id}", timeHandler(wrap(c, authWrapper(SignBlobURL)))).Methods("POST").Host("{collection}." + domainSuffix)
+	r.Handle("/{id}", timeHandler(wrap(c, optionalAuthWrapper(GetBlob)))).Methods("GET").Host("{collection}." + domainSuffix)
+	r.Handle("/{id}/poster", timeHandler(wrap(c, optionalAuthWrapper(GetPoster)))).Methods("GET").Host("{collection}." + domainSuffix)
+	r.Handle("/{id}/thumb", timeHandler(wrap(c, optionalAuthWrapper(GetThumbnail)))).Methods("GET").Host("{collection}." + domainSuffix)
+	r.Handle("/{id}/original", timeHandler(wrap(c, optionalAuthWrapper(GetOriginal)))).Methods("GET").Host("{collection}." + domainSuffix)
+	r.HandleFunc("/{id}/caption", timeHandler(wrap(c, authWrapper(CaptionItem)))).Methods("POST").Host("{collection}." + domainSuffix)
+	r.HandleFunc("/{id}", timeHandler(wrap(c, authWrapper(RemoveItem)))).Methods("DELETE").Host("{collection}." + domainSuffix)
+	r.HandleFunc("/{id}", timeHandler(wrap(c, authWrapper(RenameItem)))).Methods("PATCH").Host("{collection}." + domainSuffix)
+	r.HandleFunc("/{id}/aliases/{alias}", timeHandler(wrap(c, authWrapper(AddItemAlias)))).Methods("PUT").Host("{collection}." + domainSuffix)
+	r.HandleFunc("/{id}/aliases/{alias}", timeHandler(wrap(c, authWrapper(RemoveItemAlias)))).Methods("DELETE").Host("{collection}." + domainSuffix)
 	return r
 }
 
 func GetPathMuxer(c Context) *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", timeHandler(wrap(c, authWrapper(CreateCollection)))).Methods("POST")
-	r.HandleFunc("/{collection}", timeHandler(wrap(c, UploadHandler))).Methods("POST")
-	r.Handle("/{collection}", timeHandler(wrap(c, CollectionList))).Methods("GET")
-	r.Handle("/{collection}/{id}", timeHandler(wrap(c, GetBlob))).Methods("GET")
+	r.HandleFunc("/{collection}", timeHandler(wrap(c, authWrapper(UploadHandler)))).Methods("POST")
+	r.HandleFunc("/{collection}", timeHandler(wrap(c, authWrapper(UpdateCollection)))).Methods("PUT")
+	r.Handle("/{collection}", timeHandler(wrap(c, optionalAuthWrapper(CollectionList)))).Methods("GET")
+	r.Handle("/{collection}/_members", timeHandler(wrap(c, authWrapper(CollectionMembers)))).Methods("GET")
+	r.Handle("/{collection}/_members/{user}", timeHandler(wrap(c, authWrapper(AddCollectionMember)))).Methods("PUT")
+	r.Handle("/{collection}/_members/{user}", timeHandler(wrap(c, authWrapper(RemoveCollectionMember)))).Methods("DELETE")
+	r.Handle("/{collection}/_sign/{id}", timeHandler(wrap(c, authWrapper(SignBlobURL)))).Methods("POST")
+	r.Handle("/{collection}/{id}", timeHandler(wrap(c, optionalAuthWrapper(GetBlob)))).Methods("GET")
+	r.Handle("/{collection}/{id}/poster", timeHandler(wrap(c, optionalAuthWrapper(GetPoster)))).Methods("GET")
+	r.Handle("/{collection}/{id}/thumb", timeHandler(wrap(c, optionalAuthWrapper(GetThumbnail)))).Methods("GET")
+	r.Handle("/{collection}/{id}/original", timeHandler(wrap(c, optionalAuthWrapper(GetOriginal)))).Methods("GET")
+	r.HandleFunc("/{collection}/{id}/caption", timeHandler(wrap(c, authWrapper(CaptionItem)))).Methods("POST")
+	r.HandleFunc("/{collection}/{id}", timeHandler(wrap(c, authWrapper(RemoveItem)))).Methods("DELETE")
+	r.HandleFunc("/{collection}/{id}", timeHandler(wrap(c, authWrapper(RenameItem)))).Methods("PATCH")
+	r.HandleFunc("/{collection}/{id}/aliases/{alias}", timeHandler(wrap(c, authWrapper(AddItemAlias)))).Methods("PUT")
+	r.HandleFunc("/{collection}/{id}/aliases/{alias}", timeHandler(wrap(c, authWrapper(RemoveItemAlias)))).Methods("DELETE")
 	return r
 }
 
@@ -46,9 +77,12 @@ func authWrapper(f Handler) Handler {
 		r.Header.Del(AuthHeader)
 		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 		if bearer == "" {
+			http.Error(w, "Must be logged in", http.StatusUnauthorized)
 			return
 		}
 		if c.Authorizer == nil {
+			log.Println("Error authorizing request: no Authorizer configured")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 		user, err := c.Authorizer.Authorize(bearer, c)
@@ -65,6 +99,17 @@ func authWrapper(f Handler) Handler {
 	}
 }
 
+func optionalAuthWrapper(f Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request, c Context) {
+		if r.Header.Get("Authorization") == "" {
+			r.Header.Del(AuthHeader)
+			f(w, r, c)
+			return
+		}
+		authWrapper(f)(w, r, c)
+	}
+}
+
 func wrap(c Context, f func(w http.ResponseWriter, r *http.Request, c Context)) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Request received.")
@@ -84,6 +129,118 @@ func timeHandler(f http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+func collectionRole(c Context, collection Collection, user string) (Role, error) {
+	if user == "" {
+		return "", nil
+	}
+	// Collections created before ownership was tracked have no owner, so
+	// only their members can manage them until one is added as an owner.
+	if collection.Owner == user {
+		return RoleOwner, nil
+	}
+	role, err := c.Datastore.GetMemberFromCollection(collection.Slug, user)
+	if err == MemberNotFoundError {
+		return "", nil
+	}
+	return role, err
+}
+
+func getCollection(w http.ResponseWriter, c Context, slug string) (Collection, bool) {
+	collection, err := c.Datastore.GetCollectionData(slug)
+	if err != nil {
+		if err == CollectionNotFoundError {
+			http.Error(w, "collection doesn't exist", http.StatusNotFound)
+			return collection, false
+		}
+		log.Println("Error retrieving collection: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return collection, false
+	}
+	return collection, true
+}
+
+func hasRole(w http.ResponseWriter, r *http.Request, c Context, collection Collection, required Role) bool {
+	user := r.Header.Get(AuthHeader)
+	role, err := collectionRole(c, collection, user)
+	if err != nil {
+		log.Println("Error retrieving collection role: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if !role.Includes(required) {
+		if user == "" {
+			http.Error(w, "Must be logged in", http.StatusUnauthorized)
+			return false
+		}
+		http.Error(w, "Must be a collection "+string(required)+" to do that", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func checkRole(w http.ResponseWriter, r *http.Request, c Context, slug string, required Role) (Collection, bool) {
+	collection, ok := getCollection(w, c, slug)
+	if !ok {
+		return collection, false
+	}
+	return collection, hasRole(w, r, c, collection, required)
+}
+
+type UploadResult struct {
+	Name        string // the file name the part was uploaded with
+	Tag         string // the tag the part was stored under
+	Blob        string
+	Size        int64
+	ContentType string
+	URL         string
+	Error       string
+}
+
+type UploadResponse struct {
+	Files []UploadResult
+	Error string
+}
+
+// requestConflictPolicy reads the conflict query parameter, which defaults
+// to overwriting items whose tag is taken, as uploads always have.
+func requestConflictPolicy(w http.ResponseWriter, r *http.Request) (ConflictPolicy, bool) {
+	policy := ConflictPolicy(r.URL.Query().Get("conflict"))
+	if policy == "" {
+		policy = ConflictOverwrite
+	}
+	if !policy.Valid() {
+		http.Error(w, "conflict must be one of reject, overwrite, or rename", http.StatusBadRequest)
+		return "", false
+	}
+	return policy, true
+}
+
+func uploadError(err error, name string) (int, string) {
+	switch err {
+	case TagExistsError:
+		return http.StatusConflict, "tag " + name + " already exists"
+	case UnsupportedTypeError:
+		return http.StatusUnsupportedMediaType, name + " isn't an allowed type of file"
+	case StillImageError:
+		return http.StatusUnsupportedMediaType, name + " isn't animated, so it can't be converted to a GIF"
+	case CorruptImageError:
+		return http.StatusBadRequest, name + " is corrupt"
+	case PartTooLargeError:
+		return http.StatusRequestEntityTooLarge, name + " is too large"
+	case RequestTooLargeError:
+		return http.StatusRequestEntityTooLarge, "request is too large"
+	case QuotaExceededError:
+		return http.StatusForbidden, "upload quota exceeded"
+	case InvalidTagError:
+		return http.StatusBadRequest, name + invalidTagMessage
+	}
+	return http.StatusInternalServerError, "Internal server error"
+}
+
+// UploadHandler stores every file in a multipart request, carrying on past
+// files that fail so one bad file doesn't lose the rest. The response lists
+// the outcome of every file. Its status is 200 if every file was stored,
+// 207 if only some were, and that of the first failure if none were.
 func UploadHandler(w http.ResponseWriter, r *http.Request, c Context) {
 	user := r.Header.Get(AuthHeader)
 	if user == "" {
@@ -96,38 +253,104 @@ func UploadHandler(w http.ResponseWriter, r *http.Request, c Context) {
 		http.Error(w, "collection doesn't exist", http.StatusNotFound)
 		return
 	}
+	coll, ok := checkRole(w, r, c, collection, RoleEditor)
+	if !ok {
+		return
+	}
+	policy, ok := requestConflictPolicy(w, r)
+	if !ok {
+		return
+	}
+	if c.MaxRequestSize > 0 && r.ContentLength > c.MaxRequestSize {
+		writeUploadResponse(w, http.StatusRequestEntityTooLarge, UploadResponse{Files: []UploadResult{}, Error: "request is too large"})
+		return
+	}
+	if c.UserQuota > 0 && c.Datastore != nil {
+		used, err := c.Datastore.GetStoredBytes(user)
+		if err != nil {
+			log.Println("Error getting stored bytes: " + err.Error())
+		} else if used >= c.UserQuota && policy != ConflictOverwrite {
+			// overwriting could still free up space
+			writeUploadResponse(w, http.StatusForbidden, UploadResponse{Files: []UploadResult{}, Error: "upload quota exceeded"})
+			return
+		}
+	}
 	reader, err := r.MultipartReader()
 	if err != nil {
 		log.Println("Error creating multipart reader: " + err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, "Request must be multipart", http.StatusBadRequest)
 		return
 	}
-	ids := []string{}
+	resp := UploadResponse{Files: []UploadResult{}}
+	status := http.StatusOK
+	stored := 0
+	remaining := c.MaxRequestSize
+	fail := func(result UploadResult, code int, message string) {
+		result.Error = message
+		resp.Files = append(resp.Files, result)
+		if status == http.StatusOK {
+			status = code
+		}
+	}
 	for {
 		part, err := reader.NextPart()
 		if err != nil {
 			if err == io.EOF {
-				err = nil
 				break
 			}
 			log.Println("Error looping through reader parts: " + err.Error())
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+			fail(UploadResult{}, http.StatusBadRequest, "Couldn't read the rest of the request")
+			break
+		}
+		result := UploadResult{Name: part.FileName(), Tag: part.FileName()}
+		if result.Name == "" {
+			fail(result, http.StatusBadRequest, "Every part must have a file name")
+			continue
+		}
+		var body io.Reader = part
+		var limited *limitedReader
+		if c.MaxRequestSize > 0 {
+			limited = &limitedReader{r: part, n: remaining, err: RequestTooLargeError}
+			body = limited
+		}
+		item, info, err := Upload(r.Context(), user, coll, result.Name, policy, body, c)
+		if limited != nil {
+			remaining = limited.n
 		}
-		name := part.FileName()
-		id, err := Upload(user, collection, name, part, c)
 		if err != nil {
-			log.Println("Error uploading file: " + err.Error())
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+			code, message := uploadError(err, result.Name)
+			if code == http.StatusInternalServerError {
+				log.Println("Error uploading file: " + err.Error())
+			}
+			fail(result, code, message)
+			if err == RequestTooLargeError || err == QuotaExceededError {
+				// nothing else in the request can be stored either
+				resp.Error = message
+				break
+			}
+			continue
 		}
-		ids = append(ids, id)
+		result.Tag = item.Tag
+		result.Blob = item.Blob
+		result.Size = info.Size
+		result.ContentType = info.ContentType
+		result.URL = uploadedBlobURL(r, item.Tag)
+		resp.Files = append(resp.Files, result)
+		stored++
 	}
+	if stored > 0 && status != http.StatusOK {
+		status = http.StatusMultiStatus
+	}
+	writeUploadResponse(w, status, resp)
+}
+
+func writeUploadResponse(w http.ResponseWriter, status int, resp UploadResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	encoder := json.NewEncoder(w)
-	err = encoder.Encode(ids)
+	err := encoder.Encode(resp)
 	if err != nil {
 		log.Println("Error encoding response: " + err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
@@ -138,6 +361,13 @@ func CollectionList(w http.ResponseWriter, r *http.Request, c Context) {
 		http.Error(w, "collection doesn't exist", http.StatusNotFound)
 		return
 	}
+	data, ok := getCollection(w, c, collectionSlug)
+	if !ok {
+		return
+	}
+	if !data.listable() && !hasRole(w, r, c, data, RoleViewer) {
+		return
+	}
 	collection, err := c.Datastore.GetCollectionItems(collectionSlug)
 	if err != nil {
 		if err == CollectionNotFoundError {
@@ -157,52 +387,907 @@ func CollectionList(w http.ResponseWriter, r *http.Request, c Context) {
 	}
 }
 
-func GetBlob(w http.ResponseWriter, r *http.Request, c Context) {
+// readableItem looks up the item a download request is for, and makes sure
+// the request is allowed to see it.
+func readableItem(w http.ResponseWriter, r *http.Request, c Context) (Item, bool) {
 	vars := mux.Vars(r)
 	collection := vars["collection"]
 	if collection == "" {
 		http.Error(w, "collection doesn't exist", http.StatusNotFound)
-		return
+		return Item{}, false
 	}
 	id := vars["id"]
 	if id == "" {
 		http.Error(w, "id doesn't exist", http.StatusNotFound)
-		return
+		return Item{}, false
+	}
+	data, ok := getCollection(w, c, collection)
+	if !ok {
+		return Item{}, false
 	}
 	item, err := c.Datastore.GetItemFromCollection(collection, id)
-	if err != nil {
+	notFound := err == CollectionNotFoundError || err == BlobNotFoundError
+	if err != nil && !notFound {
 		log.Println("Error getting item: " + err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return Item{}, false
+	}
+	// Signatures only matter for collections that not everyone can read,
+	// and members can still get in with a link that's expired. Links to
+	// items that don't exist are treated like any other bad link, so they
+	// can't be used to find out which tags are taken.
+	if !data.downloadable() {
+		if hasBlobSignature(r.URL.Query()) {
+			verr := InvalidSignatureError
+			if !notFound {
+				verr = VerifyBlobSignature(c, collection, item.Blob, r.URL.Query(), time.Now())
+			}
+			role, rerr := collectionRole(c, data, r.Header.Get(AuthHeader))
+			if verr != nil && (rerr != nil || !role.Includes(RoleViewer)) {
+				if verr == ExpiredSignatureError {
+					http.Error(w, "Link has expired", http.StatusForbidden)
+					return Item{}, false
+				}
+				http.Error(w, "Invalid link signature", http.StatusForbidden)
+				return Item{}, false
+			}
+		} else if !hasRole(w, r, c, data, RoleViewer) {
+			return Item{}, false
+		}
+	}
+	if notFound {
+		http.Error(w, "id doesn't exist", http.StatusNotFound)
+		return Item{}, false
+	}
+	return item, true
+}
+
+// serveObject streams an object from storage. contentType is used when
+// storage doesn't know the object's type.
+func serveObject(w http.ResponseWriter, r *http.Request, c Context, bucket, name, contentType string) {
+	blob, info, err := GetObjectStorage(c).Get(r.Context(), bucket, name)
+	if err != nil {
+		if err == BlobNotFoundError || err == BucketNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		log.Println("Error downloading blob: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+	streamObject(w, blob, info, contentType)
+}
+
+// streamObject writes an object that's been fetched from storage, with the
+// same headers as serveObject.
+func streamObject(w http.ResponseWriter, blob io.Reader, info ObjectInfo, contentType string) {
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if info.ContentType != "" && info.ContentType != "application/octet-stream" {
+		contentType = info.ContentType
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err := io.Copy(w, blob)
+	if err != nil {
+		log.Println("Error streaming blob: " + err.Error())
+		return
+	}
+}
+
+func GetBlob(w http.ResponseWriter, r *http.Request, c Context) {
+	transform, _, err := ParseTransform(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid transformation", http.StatusBadRequest)
+		return
+	}
+	// the same URL can be a GIF or an APNG, depending on who's asking
+	w.Header().Add("Vary", "Accept")
+	item, ok := readableItem(w, r, c)
+	if !ok {
+		return
+	}
+	// blobs that aren't GIFs don't have APNG versions
+	apng := item.Frames > 0 && prefersAPNG(r.Header.Get("Accept"))
+	transform, err = transform.canonical(item)
+	if err != nil {
+		http.Error(w, "Invalid transformation", http.StatusBadRequest)
+		return
+	}
+	if transform != (Transform{}) || apng {
+		serveRendition(w, r, c, item, transform, apng)
+		return
+	}
+	contentType := ""
+	if item.Frames > 0 {
+		contentType = "image/gif"
+	}
+	serveObject(w, r, c, item.Bucket, item.Blob, contentType)
+}
+
+// serveRendition serves item's blob with t applied, as a GIF or, if apng is
+// set, as an APNG. t should already be canonical for item. Renditions are
+// made the first time they're asked for, and stored after that if t is
+// cacheable.
+func serveRendition(w http.ResponseWriter, r *http.Request, c Context, item Item, t Transform, apng bool) {
+	name, contentType := transformedName(item.Blob, t), "image/gif"
+	if apng {
+		name, contentType = apngName(item.Blob, t), "image/apng"
+	}
+	storage := GetObjectStorage(c)
+	cached, info, err := storage.Get(r.Context(), item.Bucket, name)
+	if err == nil {
+		defer cached.Close()
+		// storage can't tell an APNG from a PNG, so renditions are always
+		// served as the type they were made as
+		info.ContentType = contentType
+		streamObject(w, cached, info, "")
+		return
+	} else if err != BlobNotFoundError && err != BucketNotFoundError {
+		log.Println("Error checking for rendition: " + err.Error())
+	}
+	blob, _, err := storage.Get(r.Context(), item.Bucket, item.Blob)
+	if err != nil {
+		if err == BlobNotFoundError || err == BucketNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		log.Println("Error downloading blob: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	g, err := decodeGIF(blob)
+	blob.Close()
+	if err == PartTooLargeError {
+		http.Error(w, "GIF is too large to transform", http.StatusRequestEntityTooLarge)
 		return
+	} else if err != nil {
+		http.Error(w, "Only GIFs can be transformed", http.StatusUnsupportedMediaType)
+		return
+	}
+	out := g
+	if t != (Transform{}) {
+		out, err = t.Apply(g)
+		if err == PartTooLargeError {
+			http.Error(w, "GIF is too large to transform", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid transformation", http.StatusBadRequest)
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if apng {
+		err = encodeAPNG(&buf, out)
+	} else {
+		err = gif.EncodeAll(&buf, out)
 	}
-	_, err = c.Storage.Download(item.Bucket, item.Blob, w, c)
 	if err != nil {
-		log.Println("Error downloading from GCS: " + err.Error())
+		log.Println("Error encoding " + contentType + " rendition: " + err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
+	// items without a recorded size can't have their transformations made
+	// canonical, so their renditions aren't stored
+	if t.cacheable() && item.Width > 0 && item.Height > 0 {
+		_, err = storage.Put(r.Context(), item.Bucket, name, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			log.Println("Error storing " + contentType + " rendition: " + err.Error())
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Println("Error streaming blob: " + err.Error())
+	}
 }
 
-func CreateCollection(w http.ResponseWriter, r *http.Request, c Context) {
-	var collection Collection
+func GetPoster(w http.ResponseWriter, r *http.Request, c Context) {
+	item, ok := readableItem(w, r, c)
+	if !ok {
+		return
+	}
+	serveObject(w, r, c, item.Bucket, posterName(item.Blob), "image/png")
+}
+
+// GetOriginal serves the file an item was converted to a GIF from, if it
+// was kept.
+func GetOriginal(w http.ResponseWriter, r *http.Request, c Context) {
+	item, ok := readableItem(w, r, c)
+	if !ok {
+		return
+	}
+	if item.OriginalBlob == "" {
+		http.Error(w, "original wasn't kept", http.StatusNotFound)
+		return
+	}
+	serveObject(w, r, c, item.Bucket, item.OriginalBlob, item.OriginalType)
+}
+
+// GetThumbnail serves the thumbnail whose size is set by the size query
+// parameter, or the first configured size if it isn't set.
+func GetThumbnail(w http.ResponseWriter, r *http.Request, c Context) {
+	sizes := c.thumbnailSizes()
+	size := sizes[0]
+	if s := r.URL.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || !containsSize(sizes, size) {
+			http.Error(w, "size must be one of the configured thumbnail sizes", http.StatusBadRequest)
+			return
+		}
+	}
+	item, ok := readableItem(w, r, c)
+	if !ok {
+		return
+	}
+	serveObject(w, r, c, item.Bucket, thumbnailName(item.Blob, size), "image/png")
+}
+
+func containsSize(sizes []int, size int) bool {
+	for _, s := range sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+func RemoveItem(w http.ResponseWriter, r *http.Request, c Context) {
+	user := r.Header.Get(AuthHeader)
+	if user == "" {
+		http.Error(w, "Must be logged in", http.StatusUnauthorized)
+		return
+	}
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	if collection == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	id := vars["id"]
+	if id == "" {
+		http.Error(w, "id doesn't exist", http.StatusNotFound)
+		return
+	}
+	if _, ok := checkRole(w, r, c, collection, RoleEditor); !ok {
+		return
+	}
+	item, err := c.Datastore.GetItemFromCollection(collection, id)
+	if err == nil {
+		err = c.Datastore.RemoveItemFromCollection(collection, id)
+	}
+	if err != nil {
+		if err == CollectionNotFoundError {
+			http.Error(w, "collection doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == BlobNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		log.Println("Error removing item: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	removeUnusedBlob(r.Context(), c, item.Bucket, item.Blob)
+	if item.OriginalBlob != "" {
+		removeUnusedBlob(r.Context(), c, item.Bucket, item.OriginalBlob)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MaxTagLength is the most characters a tag or alias can have, since
+// that's all SQLStore has room for.
+const MaxTagLength = 32
+
+// Tags starting with an underscore would be shadowed by routes like
+// /{collection}/_members, so they can't be used.
+func validTag(tag string) bool {
+	return tag != "" && utf8.RuneCountInString(tag) <= MaxTagLength && !strings.HasPrefix(tag, "_") && !strings.Contains(tag, "/")
+}
+
+var invalidTagMessage = " must be 1 to " + strconv.Itoa(MaxTagLength) + " characters long, can't contain a slash, and can't start with an underscore"
+
+func RenameItem(w http.ResponseWriter, r *http.Request, c Context) {
+	user := r.Header.Get(AuthHeader)
+	if user == "" {
+		http.Error(w, "Must be logged in", http.StatusUnauthorized)
+		return
+	}
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	if collection == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	id := vars["id"]
+	if id == "" {
+		http.Error(w, "id doesn't exist", http.StatusNotFound)
+		return
+	}
+	if _, ok := checkRole(w, r, c, collection, RoleEditor); !ok {
+		return
+	}
+	var item Item
 	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&collection)
+	err := decoder.Decode(&item)
 	if err != nil {
 		log.Println("Error decoding request: " + err.Error())
 		http.Error(w, "Invalid request format", http.StatusBadRequest)
 		return
 	}
-	collection, err = c.Datastore.CreateCollection(collection.Slug, collection.Name)
+	if !validTag(item.Tag) {
+		http.Error(w, "Tag"+invalidTagMessage, http.StatusBadRequest)
+		return
+	}
+	err = c.Datastore.RenameItem(collection, id, item.Tag)
 	if err != nil {
-		log.Println("Error creating collection: " + err.Error())
+		if err == CollectionNotFoundError {
+			http.Error(w, "collection doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == BlobNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == TagExistsError {
+			http.Error(w, "tag already exists", http.StatusConflict)
+			return
+		}
+		if err == AliasRenameError {
+			http.Error(w, "id is an alias; rename the item by its tag instead", http.StatusBadRequest)
+			return
+		}
+		log.Println("Error renaming item: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	item, err = c.Datastore.GetItemFromCollection(collection, item.Tag)
+	if err != nil {
+		log.Println("Error getting item: " + err.Error())
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	encoder := json.NewEncoder(w)
-	err = encoder.Encode(collection)
+	err = encoder.Encode(item)
 	if err != nil {
 		log.Println("Error encoding response: " + err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
+
+func AddItemAlias(w http.ResponseWriter, r *http.Request, c Context) {
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	if collection == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	id := vars["id"]
+	if id == "" {
+		http.Error(w, "id doesn't exist", http.StatusNotFound)
+		return
+	}
+	alias := vars["alias"]
+	if !validTag(alias) {
+		http.Error(w, "Alias"+invalidTagMessage, http.StatusBadRequest)
+		return
+	}
+	if _, ok := checkRole(w, r, c, collection, RoleEditor); !ok {
+		return
+	}
+	err := c.Datastore.AddAliasToItem(collection, id, alias)
+	if err != nil {
+		if err == CollectionNotFoundError {
+			http.Error(w, "collection doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == BlobNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == TagExistsError {
+			http.Error(w, "tag already exists", http.StatusConflict)
+			return
+		}
+		log.Println("Error adding alias: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	item, err := c.Datastore.GetItemFromCollection(collection, id)
+	if err != nil {
+		log.Println("Error getting item: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(item)
+	if err != nil {
+		log.Println("Error encoding response: " + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func RemoveItemAlias(w http.ResponseWriter, r *http.Request, c Context) {
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	if collection == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	id := vars["id"]
+	if id == "" {
+		http.Error(w, "id doesn't exist", http.StatusNotFound)
+		return
+	}
+	if _, ok := checkRole(w, r, c, collection, RoleEditor); !ok {
+		return
+	}
+	err := c.Datastore.RemoveAliasFromItem(collection, id, vars["alias"])
+	if err != nil {
+		if err == CollectionNotFoundError {
+			http.Error(w, "collection doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == BlobNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == AliasNotFoundError {
+			http.Error(w, "alias doesn't exist", http.StatusNotFound)
+			return
+		}
+		log.Println("Error removing alias: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func CreateCollection(w http.ResponseWriter, r *http.Request, c Context) {
+	user := r.Header.Get(AuthHeader)
+	if user == "" {
+		http.Error(w, "Must be logged in", http.StatusUnauthorized)
+		return
+	}
+	var collection Collection
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&collection)
+	if err != nil {
+		log.Println("Error decoding request: " + err.Error())
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	collection, err = c.Datastore.CreateCollection(collection.Slug, collection.Name, user, collection.Visibility)
+	if err != nil {
+		if err == CollectionExistsError {
+			http.Error(w, "collection already exists", http.StatusConflict)
+			return
+		}
+		if err == InvalidVisibilityError {
+			http.Error(w, "Visibility must be one of public, unlisted, or private", http.StatusBadRequest)
+			return
+		}
+		log.Println("Error creating collection: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(collection)
+	if err != nil {
+		log.Println("Error encoding response: " + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func UpdateCollection(w http.ResponseWriter, r *http.Request, c Context) {
+	user := r.Header.Get(AuthHeader)
+	if user == "" {
+		http.Error(w, "Must be logged in", http.StatusUnauthorized)
+		return
+	}
+	vars := mux.Vars(r)
+	slug := vars["collection"]
+	if slug == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	current, ok := checkRole(w, r, c, slug, RoleOwner)
+	if !ok {
+		return
+	}
+	var collection Collection
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&collection)
+	if err != nil {
+		log.Println("Error decoding request: " + err.Error())
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	// anything left out of the request stays as it was
+	if collection.Name == "" {
+		collection.Name = current.Name
+	}
+	if collection.Visibility == "" {
+		collection.Visibility = current.Visibility
+	}
+	// Blobs are moved before the collection changes, so a failed move can
+	// be finished by making the same change again.
+	if collection.Visibility.Valid() && collection.listable() != current.listable() {
+		err = moveCollectionBlobs(r.Context(), c, slug, collection.listable())
+		if err != nil {
+			log.Println("Error moving collection blobs: " + err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = c.Datastore.UpdateCollection(slug, collection.Name, collection.Visibility)
+	if err != nil {
+		if err == CollectionNotFoundError {
+			http.Error(w, "collection doesn't exist", http.StatusNotFound)
+			return
+		}
+		if err == InvalidVisibilityError {
+			http.Error(w, "Visibility must be one of public, unlisted, or private", http.StatusBadRequest)
+			return
+		}
+		log.Println("Error updating collection: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	collection, err = c.Datastore.GetCollectionData(slug)
+	if err != nil {
+		log.Println("Error retrieving collection: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(collection)
+	if err != nil {
+		log.Println("Error encoding response: " + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func CollectionMembers(w http.ResponseWriter, r *http.Request, c Context) {
+	vars := mux.Vars(r)
+	slug := vars["collection"]
+	if slug == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	collection, ok := checkRole(w, r, c, slug, RoleViewer)
+	if !ok {
+		return
+	}
+	members, err := c.Datastore.GetCollectionMembers(slug)
+	if err != nil {
+		log.Println("Error retrieving collection members: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if collection.Owner != "" {
+		members[collection.Owner] = RoleOwner
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(members)
+	if err != nil {
+		log.Println("Error encoding response: " + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func AddCollectionMember(w http.ResponseWriter, r *http.Request, c Context) {
+	vars := mux.Vars(r)
+	slug := vars["collection"]
+	if slug == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	user := vars["user"]
+	if user == "" {
+		http.Error(w, "user doesn't exist", http.StatusNotFound)
+		return
+	}
+	collection, ok := checkRole(w, r, c, slug, RoleOwner)
+	if !ok {
+		return
+	}
+	if user == collection.Owner {
+		http.Error(w, "The collection owner's role can't be changed", http.StatusBadRequest)
+		return
+	}
+	var member struct {
+		Role Role
+	}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&member)
+	if err != nil {
+		log.Println("Error decoding request: " + err.Error())
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	err = c.Datastore.AddMemberToCollection(slug, user, member.Role)
+	if err != nil {
+		if err == InvalidRoleError {
+			http.Error(w, "Role must be one of owner, editor, or viewer", http.StatusBadRequest)
+			return
+		}
+		log.Println("Error adding collection member: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(member)
+	if err != nil {
+		log.Println("Error encoding response: " + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func RemoveCollectionMember(w http.ResponseWriter, r *http.Request, c Context) {
+	vars := mux.Vars(r)
+	slug := vars["collection"]
+	if slug == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	user := vars["user"]
+	if user == "" {
+		http.Error(w, "user doesn't exist", http.StatusNotFound)
+		return
+	}
+	required := RoleOwner
+	if user == r.Header.Get(AuthHeader) {
+		// Anyone can leave a collection they've been added to.
+		required = RoleViewer
+	}
+	if _, ok := checkRole(w, r, c, slug, required); !ok {
+		return
+	}
+	err := c.Datastore.RemoveMemberFromCollection(slug, user)
+	if err != nil {
+		if err == MemberNotFoundError {
+			http.Error(w, "user isn't a member of that collection", http.StatusNotFound)
+			return
+		}
+		log.Println("Error removing collection member: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type signedURLRequest struct {
+	ExpiresIn int64 // seconds
+}
+
+type signedURLResponse struct {
+	URL     string
+	Expires time.Time
+}
+
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// The signed URL points at the same host the request came in on, with the
+// "_sign/" segment dropped, so it works for both the path and subdomain
+// routes.
+func signedBlobURL(r *http.Request, id string, query url.Values) string {
+	path := strings.TrimSuffix(r.URL.EscapedPath(), "_sign/"+url.PathEscape(id)) + url.PathEscape(id)
+	return requestOrigin(r) + path + "?" + query.Encode()
+}
+
+// Uploads are POSTed to the collection's URL, so an item's URL is the
+// request's URL with its tag appended, on both the path and subdomain
+// routes.
+func uploadedBlobURL(r *http.Request, tag string) string {
+	return requestOrigin(r) + strings.TrimSuffix(r.URL.EscapedPath(), "/") + "/" + url.PathEscape(tag)
+}
+
+// The captioned item lives next to the item it was made from, so its URL
+// is the request's URL with the source's tag and "/caption" swapped for the
+// new tag.
+func captionedBlobURL(r *http.Request, id, tag string) string {
+	path := strings.TrimSuffix(r.URL.EscapedPath(), url.PathEscape(id)+"/caption") + url.PathEscape(tag)
+	return requestOrigin(r) + path
+}
+
+func SignBlobURL(w http.ResponseWriter, r *http.Request, c Context) {
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+	if collection == "" {
+		http.Error(w, "collection doesn't exist", http.StatusNotFound)
+		return
+	}
+	id := vars["id"]
+	if id == "" {
+		http.Error(w, "id doesn't exist", http.StatusNotFound)
+		return
+	}
+	if _, ok := checkRole(w, r, c, collection, RoleViewer); !ok {
+		return
+	}
+	item, err := c.Datastore.GetItemFromCollection(collection, id)
+	if err != nil {
+		if err == CollectionNotFoundError || err == BlobNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		log.Println("Error getting item: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var req signedURLRequest
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&req)
+	if err != nil && err != io.EOF {
+		log.Println("Error decoding request: " + err.Error())
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	// ExpiresIn is checked before it's turned into a Duration, which can
+	// overflow
+	maxExpiresIn := int64(MaxSignedURLTTL / time.Second)
+	if req.ExpiresIn < 0 || req.ExpiresIn > maxExpiresIn {
+		http.Error(w, "ExpiresIn must be between 1 and "+strconv.FormatInt(maxExpiresIn, 10)+" seconds", http.StatusBadRequest)
+		return
+	}
+	ttl := DefaultSignedURLTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	query, err := SignBlob(c, collection, item.Blob, expires)
+	if err != nil {
+		log.Println("Error signing URL: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(signedURLResponse{URL: signedBlobURL(r, id, query), Expires: expires})
+	if err != nil {
+		log.Println("Error encoding response: " + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type CaptionRequest struct {
+	Top    string
+	Bottom string
+	Tag    string // if set, the captioned GIF is added to the collection under this tag instead of being returned
+}
+
+func CaptionItem(w http.ResponseWriter, r *http.Request, c Context) {
+	user := r.Header.Get(AuthHeader)
+	if user == "" {
+		http.Error(w, "Must be logged in", http.StatusUnauthorized)
+		return
+	}
+	policy, ok := requestConflictPolicy(w, r)
+	if !ok {
+		return
+	}
+	var req CaptionRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Top) == "" && strings.TrimSpace(req.Bottom) == "" {
+		http.Error(w, "Top or Bottom must be set", http.StatusBadRequest)
+		return
+	}
+	if len(req.Top) > MaxCaptionLength || len(req.Bottom) > MaxCaptionLength {
+		http.Error(w, "Captions must be at most "+strconv.Itoa(MaxCaptionLength)+" bytes long", http.StatusBadRequest)
+		return
+	}
+	if req.Tag != "" && !validTag(req.Tag) {
+		http.Error(w, "Tag"+invalidTagMessage, http.StatusBadRequest)
+		return
+	}
+	item, ok := readableItem(w, r, c)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	var coll Collection
+	if req.Tag != "" {
+		coll, ok = checkRole(w, r, c, vars["collection"], RoleEditor)
+		if !ok {
+			return
+		}
+	}
+	blob, _, err := GetObjectStorage(c).Get(r.Context(), item.Bucket, item.Blob)
+	if err != nil {
+		if err == BlobNotFoundError || err == BucketNotFoundError {
+			http.Error(w, "id doesn't exist", http.StatusNotFound)
+			return
+		}
+		log.Println("Error downloading blob: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	g, err := decodeGIF(blob)
+	blob.Close()
+	if err == PartTooLargeError {
+		http.Error(w, "GIF is too large to caption", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Only GIFs can be captioned", http.StatusUnsupportedMediaType)
+		return
+	}
+	captioned, err := Caption(g, req.Top, req.Bottom)
+	if err == PartTooLargeError {
+		http.Error(w, "GIF is too large to caption", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println("Error captioning GIF: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, captioned)
+	if err != nil {
+		log.Println("Error encoding captioned GIF: " + err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if req.Tag == "" {
+		// nothing would point at an untagged captioned GIF, so it's
+		// handed back instead of being stored
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_, err = buf.WriteTo(w)
+		if err != nil {
+			log.Println("Error streaming captioned GIF: " + err.Error())
+		}
+		return
+	}
+	newItem, info, err := Upload(r.Context(), user, coll, req.Tag, policy, &buf, c)
+	if err != nil {
+		code, message := uploadError(err, req.Tag)
+		if code == http.StatusInternalServerError {
+			log.Println("Error uploading captioned GIF: " + err.Error())
+		}
+		http.Error(w, message, code)
+		return
+	}
+	result := UploadResult{
+		Tag:         newItem.Tag,
+		Blob:        newItem.Blob,
+		URL:         captionedBlobURL(r, vars["id"], newItem.Tag),
+		Size:        info.Size,
+		ContentType: info.ContentType,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(result)
+	if err != nil {
+		log.Println("Error encoding response: " + err.Error())
+	}
+}
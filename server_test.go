@@ -0,0 +1,335 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidTag(t *testing.T) {
+	cases := map[string]bool{
+		"shipit":                      true,
+		"ship-it.gif":                 true,
+		strings.Repeat("a", 32):       true,
+		strings.Repeat("é", 32):       true,
+		"":                            false,
+		"_members":                    false,
+		"ship/it":                     false,
+		strings.Repeat("a", 33):       false,
+		strings.Repeat("é", 32) + "a": false,
+	}
+	for tag, expected := range cases {
+		if got := validTag(tag); got != expected {
+			t.Errorf("Expected validTag(%q) to be %v, got %v", tag, expected, got)
+		}
+	}
+}
+
+func TestUploadInvalidTag(t *testing.T) {
+	c := Context{Storage: NewMemStorage(), Datastore: NewMemDatastore(), UsageTracker: NewUsageTracker(), Bucket: "gifs"}
+	collection, err := c.Datastore.CreateCollection("reactions", "Reactions", "alice", VisibilityPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"_members", strings.Repeat("a", 33)} {
+		_, _, err = Upload(context.Background(), "alice", collection, tag, ConflictReject, strings.NewReader("GIF89a"), c)
+		if err != InvalidTagError {
+			t.Errorf("Expected %v uploading as %q, got %v", InvalidTagError, tag, err)
+		}
+	}
+}
+
+func testGIF(t *testing.T, shade uint8) []byte {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Gray{shade}})
+	var buf bytes.Buffer
+	err := gif.Encode(&buf, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var errAddItem = errors.New("add item failed")
+
+// failingDatastore can't add items to collections.
+type failingDatastore struct {
+	Datastore
+}
+
+func (f failingDatastore) AddItemToCollectionWithinQuota(slug string, item Item, policy ConflictPolicy, quota int64) (Item, error) {
+	return Item{}, errAddItem
+}
+
+func TestUploadCleansUpUnusedBlobs(t *testing.T) {
+	storage := NewMemStorage()
+	datastore := NewMemDatastore()
+	c := Context{Storage: storage, Datastore: datastore, UsageTracker: NewUsageTracker(), Bucket: "gifs"}
+	collection, err := datastore.CreateCollection("reactions", "Reactions", "alice", VisibilityPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _, err := Upload(context.Background(), "alice", collection, "shared", ConflictReject, bytes.NewReader(testGIF(t, 0)), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Datastore = failingDatastore{datastore}
+	_, _, err = Upload(context.Background(), "alice", collection, "again", ConflictReject, bytes.NewReader(testGIF(t, 0)), c)
+	if err != errAddItem {
+		t.Fatalf("Expected %v, got %v", errAddItem, err)
+	}
+	if _, ok := storage.(Memstorage)["gifs"][shared.Blob]; !ok {
+		t.Errorf("Expected %s to be kept, since another item uses it", shared.Blob)
+	}
+	_, _, err = Upload(context.Background(), "alice", collection, "fresh", ConflictReject, bytes.NewReader(testGIF(t, 255)), c)
+	if err != errAddItem {
+		t.Fatalf("Expected %v, got %v", errAddItem, err)
+	}
+	for name := range storage.(Memstorage)["gifs"] {
+		if name != shared.Blob && !strings.HasPrefix(name, shared.Blob+".") {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+}
+
+// testAuthorizer accepts tokens that are the name of a user.
+type testAuthorizer map[string]bool
+
+func (a testAuthorizer) Authorize(token string, c Context) (string, error) {
+	if !a[token] {
+		return "", InvalidBearerToken
+	}
+	return token, nil
+}
+
+// handlerContext has a public collection and a private one, both owned by
+// alice, each with a "wave" item.
+func handlerContext(t *testing.T) Context {
+	c := Context{
+		Storage:      NewMemStorage(),
+		Datastore:    NewMemDatastore(),
+		UsageTracker: NewUsageTracker(),
+		Authorizer:   testAuthorizer{"alice": true, "bob": true},
+		Bucket:       "gifs",
+		RootDomain:   "gifs.test",
+	}
+	for slug, visibility := range map[string]Visibility{"reactions": VisibilityPublic, "secrets": VisibilityPrivate} {
+		collection, err := c.Datastore.CreateCollection(slug, slug, "alice", visibility)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = Upload(context.Background(), "alice", collection, "wave", ConflictReject, bytes.NewReader(testGIF(t, 0)), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// handlerMuxers serves the same requests through both muxers. Each takes
+// the collection and the path within it.
+var handlerMuxers = map[string]func(c Context, method, collection, path string) (http.Handler, *http.Request){
+	"path": func(c Context, method, collection, path string) (http.Handler, *http.Request) {
+		return GetPathMuxer(c), httptest.NewRequest(method, strings.TrimSuffix("/"+collection+path, "/"), nil)
+	},
+	"domain": func(c Context, method, collection, path string) (http.Handler, *http.Request) {
+		r := httptest.NewRequest(method, path, nil)
+		r.Host = collection + "." + c.RootDomain
+		return GetDomainMuxer(c), r
+	},
+}
+
+func TestItemHandlers(t *testing.T) {
+	cases := []struct {
+		method, collection, path, user string
+		status                         int
+	}{
+		{"GET", "reactions", "/", "", http.StatusOK},
+		{"GET", "secrets", "/", "", http.StatusUnauthorized},
+		{"GET", "secrets", "/", "bob", http.StatusForbidden},
+		{"GET", "secrets", "/", "alice", http.StatusOK},
+		{"GET", "missing", "/", "", http.StatusNotFound},
+		{"GET", "reactions", "/wave", "", http.StatusOK},
+		{"GET", "reactions", "/nope", "", http.StatusNotFound},
+		{"GET", "missing", "/wave", "", http.StatusNotFound},
+		{"GET", "secrets", "/wave", "", http.StatusUnauthorized},
+		{"GET", "secrets", "/wave", "bob", http.StatusForbidden},
+		{"GET", "secrets", "/wave", "alice", http.StatusOK},
+		{"GET", "secrets", "/nope", "alice", http.StatusNotFound},
+		{"GET", "reactions", "/wave", "mallory", http.StatusUnauthorized},
+		{"DELETE", "reactions", "/wave", "", http.StatusUnauthorized},
+		{"DELETE", "reactions", "/wave", "mallory", http.StatusUnauthorized},
+		{"DELETE", "reactions", "/wave", "bob", http.StatusForbidden},
+		{"DELETE", "reactions", "/nope", "alice", http.StatusNotFound},
+		{"DELETE", "missing", "/wave", "alice", http.StatusNotFound},
+		{"DELETE", "reactions", "/wave", "alice", http.StatusNoContent},
+		{"DELETE", "secrets", "/wave", "alice", http.StatusNoContent},
+	}
+	for muxer, route := range handlerMuxers {
+		for _, tc := range cases {
+			c := handlerContext(t)
+			h, r := route(c, tc.method, tc.collection, tc.path)
+			if tc.user != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.user)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("%s muxer: expected %s %s%s as %q to be %d, got %d: %s", muxer, tc.method, tc.collection, tc.path, tc.user, tc.status, w.Code, w.Body)
+				continue
+			}
+			if tc.method == "GET" && tc.path == "/wave" && w.Code == http.StatusOK {
+				if !bytes.Equal(w.Body.Bytes(), testGIF(t, 0)) {
+					t.Errorf("%s muxer: expected %s%s to be the uploaded GIF", muxer, tc.collection, tc.path)
+				}
+				if ct := w.Header().Get("Content-Type"); ct != "image/gif" {
+					t.Errorf("%s muxer: expected %s%s to be image/gif, got %q", muxer, tc.collection, tc.path, ct)
+				}
+			}
+			if tc.method == "GET" && tc.path == "/" && w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"wave"`) {
+				t.Errorf("%s muxer: expected %s to list wave, got %s", muxer, tc.collection, w.Body)
+			}
+			if tc.method == "DELETE" && w.Code == http.StatusNoContent {
+				_, err := c.Datastore.GetItemFromCollection(tc.collection, "wave")
+				if err != BlobNotFoundError {
+					t.Errorf("%s muxer: expected %s/wave to be removed, got %v", muxer, tc.collection, err)
+				}
+			}
+		}
+	}
+}
+
+func TestRemoveItemDeletesUnusedBlobs(t *testing.T) {
+	c := handlerContext(t)
+	collection, err := c.Datastore.GetCollectionData("reactions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, _, err := Upload(context.Background(), "alice", collection, "hello", ConflictReject, bytes.NewReader(testGIF(t, 0)), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := c.Storage.(Memstorage)["gifs"]
+	if _, ok := objects[item.Blob]; !ok {
+		t.Fatalf("Expected %s to be stored", item.Blob)
+	}
+	for i, tag := range []string{"wave", "hello"} {
+		h, r := handlerMuxers["path"](c, "DELETE", "reactions", "/"+tag)
+		r.Header.Set("Authorization", "Bearer alice")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected deleting %s to be %d, got %d: %s", tag, http.StatusNoContent, w.Code, w.Body)
+		}
+		if _, ok := objects[item.Blob]; !ok && i == 0 {
+			t.Errorf("Expected %s to be kept while another item uses it", item.Blob)
+		}
+	}
+	for name := range objects {
+		if strings.HasPrefix(name, item.Blob) {
+			t.Errorf("Expected %s to be removed with the last item using it", name)
+		}
+	}
+}
+
+func TestGetBlobMissingObject(t *testing.T) {
+	c := handlerContext(t)
+	item, err := c.Datastore.GetItemFromCollection("reactions", "wave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(c.Storage.(Memstorage)["gifs"], item.Blob)
+	for muxer, route := range handlerMuxers {
+		h, r := route(c, "GET", "reactions", "/wave")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s muxer: expected a blob missing from storage to be %d, got %d: %s", muxer, http.StatusNotFound, w.Code, w.Body)
+		}
+	}
+}
+
+func TestUpdateCollectionKeepsOmittedFields(t *testing.T) {
+	cases := []struct {
+		body       string
+		name       string
+		visibility Visibility
+	}{
+		{`{"Name":"Waves"}`, "Waves", VisibilityPublic},
+		{`{"Visibility":"unlisted"}`, "reactions", VisibilityUnlisted},
+		{`{}`, "reactions", VisibilityPublic},
+	}
+	for muxer, route := range handlerMuxers {
+		for _, tc := range cases {
+			c := handlerContext(t)
+			h, r := route(c, "PUT", "reactions", "/")
+			r.Body = io.NopCloser(strings.NewReader(tc.body))
+			r.Header.Set("Authorization", "Bearer alice")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s muxer: expected updating with %s to be %d, got %d: %s", muxer, tc.body, http.StatusOK, w.Code, w.Body)
+				continue
+			}
+			collection, err := c.Datastore.GetCollectionData("reactions")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if collection.Name != tc.name || collection.Visibility != tc.visibility {
+				t.Errorf("%s muxer: expected updating with %s to leave %q, %q, got %q, %q", muxer, tc.body, tc.name, tc.visibility, collection.Name, collection.Visibility)
+			}
+		}
+	}
+}
+
+func TestRenditionsRemovedWithBlob(t *testing.T) {
+	c := handlerContext(t)
+	item, err := c.Datastore.GetItemFromCollection("reactions", "wave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, path, body string) {
+		h, r := handlerMuxers["path"](c, method, "reactions", path)
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer alice")
+		if path == "/wave" {
+			r.Header.Set("Accept", "image/apng,image/gif;q=0.8")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %s %s to be %d, got %d: %s", method, path, http.StatusOK, w.Code, w.Body)
+		}
+	}
+	serve("GET", "/wave?reverse=true", "")
+	serve("GET", "/wave?width=2", "")
+	serve("GET", "/wave", "")
+	objects := c.Storage.(Memstorage)["gifs"]
+	stored := map[string]bool{
+		transformedName(item.Blob, Transform{Reverse: true}): true,
+		apngName(item.Blob, Transform{}):                     true,
+	}
+	for name := range stored {
+		if _, ok := objects[name]; !ok {
+			t.Errorf("Expected %s to be stored", name)
+		}
+	}
+	for name := range objects {
+		if strings.HasPrefix(name, renditionPrefix) && !stored[name] {
+			t.Errorf("Expected only cacheable renditions to be stored, got %s", name)
+		}
+	}
+	serve("PUT", "/", `{"Visibility":"private"}`)
+	for name := range objects {
+		if strings.HasPrefix(name, renditionPrefix+item.Blob+"/") {
+			t.Errorf("Expected %s to be removed with its blob", name)
+		}
+	}
+}
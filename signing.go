@@ -0,0 +1,99 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSignedURLTTL = time.Hour
+	MaxSignedURLTTL     = 7 * 24 * time.Hour
+
+	signatureParam = "signature"
+	expiresParam   = "expires"
+	keyIDParam     = "key"
+)
+
+var (
+	NoSigningKeyError     = errors.New("no signing key configured")
+	InvalidSignatureError = errors.New("invalid signature")
+	ExpiredSignatureError = errors.New("signature has expired")
+)
+
+// signingKey returns the key new URLs are signed with. Every key in
+// SigningKeys is still accepted when verifying, so old keys can be kept
+// around until the URLs they signed have expired.
+func (c Context) signingKey() (string, []byte, error) {
+	if c.SigningKeyID != "" {
+		key, ok := c.SigningKeys[c.SigningKeyID]
+		if !ok {
+			return "", nil, NoSigningKeyError
+		}
+		return c.SigningKeyID, key, nil
+	}
+	if len(c.SigningKeys) < 1 {
+		return "", nil, NoSigningKeyError
+	}
+	ids := make([]string, 0, len(c.SigningKeys))
+	for id := range c.SigningKeys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	id := ids[len(ids)-1]
+	return id, c.SigningKeys[id], nil
+}
+
+// Signatures cover the hash of the blob instead of the tag it's under, so a
+// link stops working if the tag is moved to something else. Moving a blob
+// when its collection's visibility changes doesn't change its hash.
+func blobSignature(key []byte, collection, blob string, expires int64) string {
+	hash := strings.TrimPrefix(blob, privateBlobPrefix)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(collection + "\n" + hash + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignBlob returns the query parameters that let anyone download blob from
+// collection until expires, without logging in.
+func SignBlob(c Context, collection, blob string, expires time.Time) (url.Values, error) {
+	keyID, key, err := c.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	exp := expires.Unix()
+	return url.Values{
+		keyIDParam:     {keyID},
+		expiresParam:   {strconv.FormatInt(exp, 10)},
+		signatureParam: {blobSignature(key, collection, blob, exp)},
+	}, nil
+}
+
+func hasBlobSignature(query url.Values) bool {
+	return query.Get(signatureParam) != ""
+}
+
+func VerifyBlobSignature(c Context, collection, blob string, query url.Values, now time.Time) error {
+	key, ok := c.SigningKeys[query.Get(keyIDParam)]
+	if !ok {
+		return InvalidSignatureError
+	}
+	exp, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil {
+		return InvalidSignatureError
+	}
+	expected := blobSignature(key, collection, blob, exp)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signatureParam))) {
+		return InvalidSignatureError
+	}
+	if now.Unix() > exp {
+		return ExpiredSignatureError
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyBlobSignature(t *testing.T) {
+	c := Context{SigningKeys: map[string][]byte{"old": []byte("old secret"), "new": []byte("new secret")}, SigningKeyID: "new"}
+	now := time.Unix(1500000000, 0)
+	query, err := SignBlob(c, "reactions", "abc123", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Error signing: %s", err)
+	}
+	cases := []struct {
+		name, collection, blob string
+		now                    time.Time
+		expected               error
+	}{
+		{"valid", "reactions", "abc123", now, nil},
+		{"moved to private", "reactions", "private/abc123", now, nil},
+		{"other blob", "reactions", "def456", now, InvalidSignatureError},
+		{"other collection", "cats", "abc123", now, InvalidSignatureError},
+		{"expired", "reactions", "abc123", now.Add(2 * time.Minute), ExpiredSignatureError},
+	}
+	for _, tc := range cases {
+		err := VerifyBlobSignature(c, tc.collection, tc.blob, query, tc.now)
+		if err != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+	query.Set(keyIDParam, "missing")
+	if err := VerifyBlobSignature(c, "reactions", "abc123", query, now); err != InvalidSignatureError {
+		t.Errorf("Expected %v for an unknown key, got %v", InvalidSignatureError, err)
+	}
+}
@@ -2,91 +2,922 @@ package api
 
 import (
 	"database/sql"
+	"errors"
+	"log"
+	"sort"
 
+	"github.com/go-sql-driver/mysql"
 	"secondbit.org/pan"
 )
 
 const (
 	collectionTable = "collections"
 	itemTable       = "items"
+	memberTable     = "members"
+	aliasTable      = "aliases"
+
+	itemMetadataColumns = "width, height, frames, duration, loop_count, size, original_size, original_blob, original_type, uploader"
+)
+
+// DuplicateKeysError is returned by Init when a table it needs to add a
+// primary key to has rows that share a key. They have to be removed by hand
+// before Init can succeed.
+var DuplicateKeysError = errors.New("table has rows with duplicate keys")
+
+// MySQL error numbers SQLStore handles.
+const (
+	mysqlDuplicateKeyName    = 1061
+	mysqlDuplicateEntry      = 1062
+	mysqlMultiplePrimaryKeys = 1068
 )
 
 type SQLStore sql.DB
 
+func (s *SQLStore) isMySQL() bool {
+	_, ok := (*sql.DB)(s).Driver().(*mysql.MySQLDriver)
+	return ok
+}
+
+func isMySQLError(err error, number uint16) bool {
+	e, ok := err.(*mysql.MySQLError)
+	return ok && e.Number == number
+}
+
+// sqlQueryer is what *sql.DB and *sql.Tx have in common, so lookups can be
+// shared between plain reads and the transactions writes run in.
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// inTx runs f in a transaction, committing it if f succeeds and rolling it
+// back otherwise.
+func (s *SQLStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := (*sql.DB)(s).Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func createCollectionTableSQL() *pan.Query {
 	query := pan.New(pan.MYSQL, "CREATE TABLE IF NOT EXISTS "+collectionTable)
-	query.Include("(slug VARCHAR(32), name VARCHAR(64))")
+	query.Include("(slug VARCHAR(32), name VARCHAR(64), owner VARCHAR(64) NOT NULL DEFAULT '', visibility VARCHAR(16) NOT NULL DEFAULT 'public', PRIMARY KEY (slug))")
 	return query.FlushExpressions(" ")
 }
 
 func createItemTableSQL() *pan.Query {
 	query := pan.New(pan.MYSQL, "CREATE TABLE IF NOT EXISTS "+itemTable)
-	query.Include("(tag VARCHAR(32), collection VARCHAR(32), sha VARCHAR(64), bucket VARCHAR(64))")
+	query.Include("(tag VARCHAR(32), collection VARCHAR(32), sha VARCHAR(64), bucket VARCHAR(64), width INT NOT NULL DEFAULT 0, height INT NOT NULL DEFAULT 0, frames INT NOT NULL DEFAULT 0, duration INT NOT NULL DEFAULT 0, loop_count INT NOT NULL DEFAULT 0, size BIGINT NOT NULL DEFAULT 0, original_size BIGINT NOT NULL DEFAULT 0, original_blob VARCHAR(64) NOT NULL DEFAULT '', original_type VARCHAR(64) NOT NULL DEFAULT '', uploader VARCHAR(64) NOT NULL DEFAULT '', PRIMARY KEY (collection, tag))")
 	return query.FlushExpressions(" ")
 }
 
+func createMemberTableSQL() *pan.Query {
+	query := pan.New(pan.MYSQL, "CREATE TABLE IF NOT EXISTS "+memberTable)
+	query.Include("(collection VARCHAR(32), user_id VARCHAR(64), role VARCHAR(16), PRIMARY KEY (collection, user_id))")
+	return query.FlushExpressions(" ")
+}
+
+func createAliasTableSQL() *pan.Query {
+	query := pan.New(pan.MYSQL, "CREATE TABLE IF NOT EXISTS "+aliasTable)
+	query.Include("(collection VARCHAR(32), alias VARCHAR(32), tag VARCHAR(32), PRIMARY KEY (collection, alias))")
+	return query.FlushExpressions(" ")
+}
+
+// columnMigrations are the columns added to tables after they were first
+// created. CREATE TABLE IF NOT EXISTS leaves tables that already exist as
+// they are, so Init adds any of these that are missing.
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{collectionTable, "owner", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{collectionTable, "visibility", "VARCHAR(16) NOT NULL DEFAULT 'public'"},
+	{itemTable, "width", "INT NOT NULL DEFAULT 0"},
+	{itemTable, "height", "INT NOT NULL DEFAULT 0"},
+	{itemTable, "frames", "INT NOT NULL DEFAULT 0"},
+	{itemTable, "duration", "INT NOT NULL DEFAULT 0"},
+	{itemTable, "loop_count", "INT NOT NULL DEFAULT 0"},
+	{itemTable, "size", "BIGINT NOT NULL DEFAULT 0"},
+	{itemTable, "original_size", "BIGINT NOT NULL DEFAULT 0"},
+	{itemTable, "original_blob", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{itemTable, "original_type", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{itemTable, "uploader", "VARCHAR(64) NOT NULL DEFAULT ''"},
+}
+
+// primaryKeyMigrations are the primary keys tables were first created
+// without. Init adds them to tables that already existed, when they're
+// MySQL tables; other databases can't add a primary key to a table.
+var primaryKeyMigrations = []struct {
+	table, columns string
+}{
+	{collectionTable, "slug"},
+	{itemTable, "collection, tag"},
+}
+
+// indexMigrations are the indexes Init makes sure every table has. Quota
+// checks lock the rows they add up, so without an index on uploader they
+// would lock every item.
+var indexMigrations = []struct {
+	name, table, columns string
+}{
+	{"items_uploader", itemTable, "uploader"},
+}
+
 func (s *SQLStore) Init(name string) error {
-	tableInits := []*pan.Query{createCollectionTableSQL(), createItemTableSQL()}
+	existed := map[string]bool{}
+	for _, m := range primaryKeyMigrations {
+		_, err := s.tableColumns(m.table)
+		existed[m.table] = err == nil
+	}
+	tableInits := []*pan.Query{createCollectionTableSQL(), createItemTableSQL(), createMemberTableSQL(), createAliasTableSQL()}
 	for _, query := range tableInits {
 		_, err := (*sql.DB)(s).Exec(query.String(), query.Args...)
 		if err != nil {
 			return err
 		}
 	}
+	err := s.migrate()
+	if err != nil {
+		return err
+	}
+	err = s.migrateIndexes()
+	if err != nil {
+		return err
+	}
+	return s.migratePrimaryKeys(existed)
+}
+
+func tableColumnsSQL(table string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT * FROM "+table)
+	query.Include("LIMIT 0")
+	return query.FlushExpressions(" ")
+}
+
+func addColumnSQL(table, column, definition string) *pan.Query {
+	query := pan.New(pan.MYSQL, "ALTER TABLE "+table)
+	query.Include("ADD COLUMN " + column + " " + definition)
+	return query.FlushExpressions(" ")
+}
+
+func addPrimaryKeySQL(table, columns string) *pan.Query {
+	query := pan.New(pan.MYSQL, "ALTER TABLE "+table)
+	query.Include("ADD PRIMARY KEY (" + columns + ")")
+	return query.FlushExpressions(" ")
+}
+
+// createIndexSQL creates an index. MySQL has no CREATE INDEX IF NOT EXISTS,
+// so there an existing index is an error that has to be ignored.
+func createIndexSQL(name, table, columns string, ifNotExists bool) *pan.Query {
+	create := "CREATE INDEX "
+	if ifNotExists {
+		create += "IF NOT EXISTS "
+	}
+	query := pan.New(pan.MYSQL, create+name)
+	query.Include("ON " + table + " (" + columns + ")")
+	return query.FlushExpressions(" ")
+}
+
+func (s *SQLStore) tableColumns(table string) (map[string]bool, error) {
+	query := tableColumnsSQL(table)
+	rows, err := (*sql.DB)(s).Query(query.String(), query.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]bool{}
+	for _, name := range names {
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+func (s *SQLStore) migrate() error {
+	for _, m := range columnMigrations {
+		columns, err := s.tableColumns(m.table)
+		if err != nil {
+			return err
+		}
+		if columns[m.column] {
+			continue
+		}
+		query := addColumnSQL(m.table, m.column, m.definition)
+		_, err = (*sql.DB)(s).Exec(query.String(), query.Args...)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func createCollectionSQL(slug, name string) *pan.Query {
-	query := pan.New(pan.MYSQL, "INSERT INTO "+collectionTable+" (slug, name)")
-	query.Include("VALUES (?,?)", slug, name)
+func (s *SQLStore) migrateIndexes() error {
+	for _, m := range indexMigrations {
+		query := createIndexSQL(m.name, m.table, m.columns, !s.isMySQL())
+		_, err := (*sql.DB)(s).Exec(query.String(), query.Args...)
+		if err != nil && !isMySQLError(err, mysqlDuplicateKeyName) {
+			return err
+		}
+	}
+	return nil
+}
+
+// migratePrimaryKeys adds primaryKeyMigrations to the tables in existed
+// that Init didn't create. Tables that already have a primary key are left
+// as they are.
+func (s *SQLStore) migratePrimaryKeys(existed map[string]bool) error {
+	if !s.isMySQL() {
+		return nil
+	}
+	for _, m := range primaryKeyMigrations {
+		if !existed[m.table] {
+			continue
+		}
+		query := addPrimaryKeySQL(m.table, m.columns)
+		_, err := (*sql.DB)(s).Exec(query.String(), query.Args...)
+		if isMySQLError(err, mysqlMultiplePrimaryKeys) {
+			continue
+		} else if isMySQLError(err, mysqlDuplicateEntry) {
+			log.Printf("Error adding a primary key to %s: more than one row has the same %s. Remove the duplicates and try again.\n", m.table, m.columns)
+			return DuplicateKeysError
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createCollectionSQL(slug, name, owner string, visibility Visibility) *pan.Query {
+	query := pan.New(pan.MYSQL, "INSERT INTO "+collectionTable+" (slug, name, owner, visibility)")
+	query.Include("VALUES (?,?,?,?)", slug, name, owner, string(visibility))
 	return query.FlushExpressions(" ")
 }
 
-func (s *SQLStore) CreateCollection(slug, name string) (Collection, error) {
-	query := createCollectionSQL(slug, name)
-	_, err := (*sql.DB)(s).Exec(query.String(), query.Args...)
+func (s *SQLStore) CreateCollection(slug, name, owner string, visibility Visibility) (Collection, error) {
+	visibility, err := visibility.normalize()
 	if err != nil {
 		return Collection{}, err
 	}
-	return Collection{Slug: slug, Name: name, Items: make(map[string]Item)}, nil
+	_, err = s.GetCollectionData(slug)
+	if err == nil {
+		return Collection{}, CollectionExistsError
+	} else if err != CollectionNotFoundError {
+		return Collection{}, err
+	}
+	query := createCollectionSQL(slug, name, owner, visibility)
+	_, err = (*sql.DB)(s).Exec(query.String(), query.Args...)
+	if isMySQLError(err, mysqlDuplicateEntry) {
+		return Collection{}, CollectionExistsError
+	} else if err != nil {
+		return Collection{}, err
+	}
+	return Collection{Slug: slug, Name: name, Owner: owner, Visibility: visibility, Items: make(map[string]Item)}, nil
 }
 
-func (s *SQLStore) UpdateCollection(slug, name string) error {
-	return nil
+func updateCollectionSQL(slug, name string, visibility Visibility) *pan.Query {
+	query := pan.New(pan.MYSQL, "UPDATE "+collectionTable+" SET")
+	query.Include("name=?", name)
+	query.Include("visibility=?", string(visibility))
+	query.FlushExpressions(", ")
+	query.IncludeWhere()
+	query.Include("slug=?", slug)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) UpdateCollection(slug, name string, visibility Visibility) error {
+	visibility, err := visibility.normalize()
+	if err != nil {
+		return err
+	}
+	query := updateCollectionSQL(slug, name, visibility)
+	res, err := (*sql.DB)(s).Exec(query.String(), query.Args...)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+	// MySQL doesn't count rows that matched but didn't change, so make
+	// sure the collection actually exists before calling it a success.
+	_, err = s.GetCollectionData(slug)
+	return err
+}
+
+func getCollectionDataSQL(slug string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT slug, name, owner, visibility FROM "+collectionTable)
+	query.IncludeWhere()
+	query.Include("slug=?", slug)
+	return query.FlushExpressions(" AND ")
 }
 
 func (s *SQLStore) GetCollectionData(slug string) (Collection, error) {
-	return Collection{}, nil
+	return getCollectionData((*sql.DB)(s), slug)
+}
+
+func getCollectionData(q sqlQueryer, slug string) (Collection, error) {
+	query := getCollectionDataSQL(slug)
+	var c Collection
+	var visibility string
+	err := q.QueryRow(query.String(), query.Args...).Scan(&c.Slug, &c.Name, &c.Owner, &visibility)
+	if err == sql.ErrNoRows {
+		return Collection{}, CollectionNotFoundError
+	}
+	c.Visibility = Visibility(visibility)
+	return c, err
+}
+
+func getCollectionItemsSQL(slug string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT tag, sha, bucket, "+itemMetadataColumns+" FROM "+itemTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	return query.FlushExpressions(" AND ")
+}
+
+func getCollectionAliasesSQL(slug string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT alias, tag FROM "+aliasTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	return query.FlushExpressions(" AND ")
 }
 
 func (s *SQLStore) GetCollectionItems(slug string) (map[string]Item, error) {
-	return map[string]Item{}, nil
+	_, err := s.GetCollectionData(slug)
+	if err != nil {
+		return map[string]Item{}, err
+	}
+	query := getCollectionItemsSQL(slug)
+	rows, err := (*sql.DB)(s).Query(query.String(), query.Args...)
+	if err != nil {
+		return map[string]Item{}, err
+	}
+	defer rows.Close()
+	items := map[string]Item{}
+	for rows.Next() {
+		var i Item
+		err = rows.Scan(append([]interface{}{&i.Tag, &i.Blob, &i.Bucket}, metadataFields(&i.Metadata)...)...)
+		if err != nil {
+			return map[string]Item{}, err
+		}
+		i.Aliases = []string{}
+		items[i.Tag] = i
+	}
+	err = rows.Err()
+	if err != nil {
+		return map[string]Item{}, err
+	}
+	aliases, err := getAliases((*sql.DB)(s), getCollectionAliasesSQL(slug))
+	if err != nil {
+		return map[string]Item{}, err
+	}
+	for tag, a := range aliases {
+		if i, ok := items[tag]; ok {
+			i.Aliases = a
+			items[tag] = i
+		}
+	}
+	return items, nil
+}
+
+// getAliases runs a query that selects alias, tag pairs and groups the
+// aliases by the tag they point to.
+func getAliases(q sqlQueryer, query *pan.Query) (map[string][]string, error) {
+	rows, err := q.Query(query.String(), query.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aliases := map[string][]string{}
+	for rows.Next() {
+		var alias, tag string
+		err = rows.Scan(&alias, &tag)
+		if err != nil {
+			return nil, err
+		}
+		aliases[tag] = append(aliases[tag], alias)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range aliases {
+		sort.Strings(a)
+	}
+	return aliases, nil
+}
+
+// metadataFields and metadataValues line up with itemMetadataColumns.
+func metadataFields(m *Metadata) []interface{} {
+	return []interface{}{&m.Width, &m.Height, &m.Frames, &m.Duration, &m.LoopCount, &m.Size, &m.OriginalSize, &m.OriginalBlob, &m.OriginalType, &m.Uploader}
+}
+
+func metadataValues(m Metadata) []interface{} {
+	return []interface{}{m.Width, m.Height, m.Frames, m.Duration, m.LoopCount, m.Size, m.OriginalSize, m.OriginalBlob, m.OriginalType, m.Uploader}
 }
 
 func addItemToCollectionSQL(slug string, item Item) *pan.Query {
-	query := pan.New(pan.MYSQL, "INSERT INTO "+itemTable+" (tag, collection, sha, bucket)")
-	query.Include("VALUES (?,?,?,?)", item.Tag, slug, item.Blob, item.Bucket)
+	query := pan.New(pan.MYSQL, "INSERT INTO "+itemTable+" (tag, collection, sha, bucket, "+itemMetadataColumns+")")
+	query.Include("VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?)", append([]interface{}{item.Tag, slug, item.Blob, item.Bucket}, metadataValues(item.Metadata)...)...)
 	return query.FlushExpressions(" ")
 }
 
-func (s *SQLStore) AddItemToCollection(slug string, item Item) error {
-	query := addItemToCollectionSQL(slug, item)
-	_, err := (*sql.DB)(s).Exec(query.String(), query.Args...)
-	return err
+func overwriteItemSQL(slug string, item Item) *pan.Query {
+	query := pan.New(pan.MYSQL, "UPDATE "+itemTable+" SET")
+	query.Include("sha=?", item.Blob)
+	query.Include("bucket=?", item.Bucket)
+	query.Include("width=?", item.Width)
+	query.Include("height=?", item.Height)
+	query.Include("frames=?", item.Frames)
+	query.Include("duration=?", item.Duration)
+	query.Include("loop_count=?", item.LoopCount)
+	query.Include("size=?", item.Size)
+	query.Include("original_size=?", item.OriginalSize)
+	query.Include("original_blob=?", item.OriginalBlob)
+	query.Include("original_type=?", item.OriginalType)
+	query.Include("uploader=?", item.Uploader)
+	query.FlushExpressions(", ")
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("tag=?", item.Tag)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) AddItemToCollection(slug string, item Item, policy ConflictPolicy) (Item, error) {
+	return s.AddItemToCollectionWithinQuota(slug, item, policy, 0)
+}
+
+func (s *SQLStore) AddItemToCollectionWithinQuota(slug string, item Item, policy ConflictPolicy, quota int64) (Item, error) {
+	if !policy.Valid() {
+		return Item{}, InvalidConflictPolicyError
+	}
+	var added Item
+	err := s.inTx(func(tx *sql.Tx) error {
+		existing, err := getItemFromCollection(tx, slug, item.Tag)
+		if err == nil {
+			switch policy {
+			case ConflictReject:
+				return TagExistsError
+			case ConflictOverwrite:
+				err = s.checkQuota(tx, item.Metadata, existing.Metadata, quota)
+				if err != nil {
+					return err
+				}
+				existing.Blob = item.Blob
+				existing.Bucket = item.Bucket
+				existing.Metadata = item.Metadata
+				query := overwriteItemSQL(slug, existing)
+				_, err = tx.Exec(query.String(), query.Args...)
+				if err != nil {
+					return err
+				}
+				added = existing
+				return nil
+			case ConflictRename:
+				tag := item.Tag
+				for n := 2; err == nil; n++ {
+					if n > maxTagSuffix {
+						return TagExistsError
+					}
+					item.Tag = suffixedTag(tag, n)
+					_, err = getItemFromCollection(tx, slug, item.Tag)
+				}
+			}
+		}
+		if err != BlobNotFoundError {
+			return err
+		}
+		err = s.checkQuota(tx, item.Metadata, Metadata{}, quota)
+		if err != nil {
+			return err
+		}
+		// the tag can still be taken between looking it up and inserting it
+		query := addItemToCollectionSQL(slug, item)
+		_, err = tx.Exec(query.String(), query.Args...)
+		if isMySQLError(err, mysqlDuplicateEntry) {
+			return TagExistsError
+		} else if err != nil {
+			return err
+		}
+		added = item
+		added.Aliases = []string{}
+		return nil
+	})
+	if err != nil {
+		return Item{}, err
+	}
+	return added, nil
+}
+
+func storedBytesSQL(user string, lock bool) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT COALESCE(SUM(size), 0) FROM "+itemTable)
+	query.IncludeWhere()
+	query.Include("uploader=?", user)
+	query.FlushExpressions(" AND ")
+	if lock {
+		query.Include("FOR UPDATE")
+		query.FlushExpressions(" ")
+	}
+	return query
+}
+
+// checkQuota returns QuotaExceededError if storing an item with metadata,
+// in place of one with replaced, takes its uploader over quota. On MySQL,
+// the uploader's items stay locked until tx is done, so uploads running at
+// the same time can't both fit in what's left of the quota. SQLite, which
+// the tests use when there's no MySQL to run against, only lets one
+// transaction write at a time anyway.
+func (s *SQLStore) checkQuota(tx *sql.Tx, metadata, replaced Metadata, quota int64) error {
+	if quota <= 0 {
+		return nil
+	}
+	query := storedBytesSQL(metadata.Uploader, s.isMySQL())
+	var used int64
+	err := tx.QueryRow(query.String(), query.Args...).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if replaced.Uploader == metadata.Uploader {
+		used -= replaced.Size
+	}
+	if used+metadata.Size > quota {
+		return QuotaExceededError
+	}
+	return nil
+}
+
+func (s *SQLStore) GetStoredBytes(user string) (int64, error) {
+	query := storedBytesSQL(user, false)
+	var used int64
+	err := (*sql.DB)(s).QueryRow(query.String(), query.Args...).Scan(&used)
+	return used, err
 }
 
 func getItemFromCollectionSQL(slug, tag string) *pan.Query {
-	query := pan.New(pan.MYSQL, "SELECT tag, collection, sha, bucket FROM "+itemTable)
+	query := pan.New(pan.MYSQL, "SELECT tag, collection, sha, bucket, "+itemMetadataColumns+" FROM "+itemTable)
 	query.IncludeWhere()
 	query.Include("collection=?", slug)
 	query.Include("tag=?", tag)
 	return query.FlushExpressions(" AND ")
 }
 
-func (s *SQLStore) GetItemFromCollection(slug, tag string) (Item, error) {
+func getAliasSQL(slug, alias string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT tag FROM "+aliasTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("alias=?", alias)
+	return query.FlushExpressions(" AND ")
+}
+
+func getItemAliasesSQL(slug, tag string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT alias, tag FROM "+aliasTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("tag=?", tag)
+	return query.FlushExpressions(" AND ")
+}
+
+func getItem(q sqlQueryer, slug, tag string) (Item, error) {
 	query := getItemFromCollectionSQL(slug, tag)
 	var i Item
 	var collection string
-	err := (*sql.DB)(s).QueryRow(query.String(), query.Args...).Scan(&i.Tag, &collection, &i.Blob, &i.Bucket)
+	err := q.QueryRow(query.String(), query.Args...).Scan(append([]interface{}{&i.Tag, &collection, &i.Blob, &i.Bucket}, metadataFields(&i.Metadata)...)...)
+	if err == sql.ErrNoRows {
+		return Item{}, BlobNotFoundError
+	}
 	return i, err
 }
+
+func (s *SQLStore) GetItemFromCollection(slug, tag string) (Item, error) {
+	return getItemFromCollection((*sql.DB)(s), slug, tag)
+}
+
+func getItemFromCollection(q sqlQueryer, slug, tag string) (Item, error) {
+	_, err := getCollectionData(q, slug)
+	if err != nil {
+		return Item{}, err
+	}
+	i, err := getItem(q, slug, tag)
+	if err == BlobNotFoundError {
+		query := getAliasSQL(slug, tag)
+		err = q.QueryRow(query.String(), query.Args...).Scan(&tag)
+		if err == sql.ErrNoRows {
+			return Item{}, BlobNotFoundError
+		} else if err != nil {
+			return Item{}, err
+		}
+		i, err = getItem(q, slug, tag)
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	aliases, err := getAliases(q, getItemAliasesSQL(slug, i.Tag))
+	if err != nil {
+		return Item{}, err
+	}
+	i.Aliases = aliases[i.Tag]
+	if i.Aliases == nil {
+		i.Aliases = []string{}
+	}
+	return i, nil
+}
+
+func removeItemFromCollectionSQL(slug, tag string) *pan.Query {
+	query := pan.New(pan.MYSQL, "DELETE FROM "+itemTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("tag=?", tag)
+	return query.FlushExpressions(" AND ")
+}
+
+func removeItemAliasesSQL(slug, tag string) *pan.Query {
+	query := pan.New(pan.MYSQL, "DELETE FROM "+aliasTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("tag=?", tag)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) RemoveItemFromCollection(slug, tag string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		item, err := getItemFromCollection(tx, slug, tag)
+		if err != nil {
+			return err
+		}
+		query := removeItemFromCollectionSQL(slug, item.Tag)
+		res, err := tx.Exec(query.String(), query.Args...)
+		if err != nil {
+			return err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows < 1 {
+			return BlobNotFoundError
+		}
+		query = removeItemAliasesSQL(slug, item.Tag)
+		_, err = tx.Exec(query.String(), query.Args...)
+		return err
+	})
+}
+
+func renameItemSQL(slug, oldTag, newTag string) *pan.Query {
+	query := pan.New(pan.MYSQL, "UPDATE "+itemTable+" SET")
+	query.Include("tag=?", newTag)
+	query.FlushExpressions(", ")
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("tag=?", oldTag)
+	return query.FlushExpressions(" AND ")
+}
+
+func renameItemAliasesSQL(slug, oldTag, newTag string) *pan.Query {
+	query := pan.New(pan.MYSQL, "UPDATE "+aliasTable+" SET")
+	query.Include("tag=?", newTag)
+	query.FlushExpressions(", ")
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("tag=?", oldTag)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) RenameItem(slug, oldTag, newTag string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		item, err := getItemFromCollection(tx, slug, oldTag)
+		if err != nil {
+			return err
+		}
+		if item.Tag != oldTag {
+			return AliasRenameError
+		}
+		if oldTag == newTag {
+			return nil
+		}
+		_, err = getItemFromCollection(tx, slug, newTag)
+		if err == nil {
+			return TagExistsError
+		} else if err != BlobNotFoundError {
+			return err
+		}
+		query := renameItemSQL(slug, item.Tag, newTag)
+		res, err := tx.Exec(query.String(), query.Args...)
+		if isMySQLError(err, mysqlDuplicateEntry) {
+			return TagExistsError
+		} else if err != nil {
+			return err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows < 1 {
+			return BlobNotFoundError
+		}
+		query = renameItemAliasesSQL(slug, item.Tag, newTag)
+		_, err = tx.Exec(query.String(), query.Args...)
+		return err
+	})
+}
+
+func addAliasSQL(slug, tag, alias string) *pan.Query {
+	query := pan.New(pan.MYSQL, "INSERT INTO "+aliasTable+" (collection, alias, tag)")
+	query.Include("VALUES (?,?,?)", slug, alias, tag)
+	return query.FlushExpressions(" ")
+}
+
+func (s *SQLStore) AddAliasToItem(slug, tag, alias string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		item, err := getItemFromCollection(tx, slug, tag)
+		if err != nil {
+			return err
+		}
+		existing, err := getItemFromCollection(tx, slug, alias)
+		if err == nil {
+			if existing.Tag == item.Tag && alias != item.Tag {
+				return nil
+			}
+			return TagExistsError
+		} else if err != BlobNotFoundError {
+			return err
+		}
+		query := addAliasSQL(slug, item.Tag, alias)
+		_, err = tx.Exec(query.String(), query.Args...)
+		if isMySQLError(err, mysqlDuplicateEntry) {
+			return TagExistsError
+		}
+		return err
+	})
+}
+
+func removeAliasSQL(slug, tag, alias string) *pan.Query {
+	query := pan.New(pan.MYSQL, "DELETE FROM "+aliasTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("alias=?", alias)
+	query.Include("tag=?", tag)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) RemoveAliasFromItem(slug, tag, alias string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		item, err := getItemFromCollection(tx, slug, tag)
+		if err != nil {
+			return err
+		}
+		query := removeAliasSQL(slug, item.Tag, alias)
+		res, err := tx.Exec(query.String(), query.Args...)
+		if err != nil {
+			return err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows < 1 {
+			return AliasNotFoundError
+		}
+		return nil
+	})
+}
+
+func addMemberToCollectionSQL(slug, user string, role Role) *pan.Query {
+	query := pan.New(pan.MYSQL, "INSERT INTO "+memberTable+" (collection, user_id, role)")
+	query.Include("VALUES (?,?,?)", slug, user, string(role))
+	return query.FlushExpressions(" ")
+}
+
+func updateMemberSQL(slug, user string, role Role) *pan.Query {
+	query := pan.New(pan.MYSQL, "UPDATE "+memberTable+" SET")
+	query.Include("role=?", string(role))
+	query.FlushExpressions(", ")
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("user_id=?", user)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) AddMemberToCollection(slug, user string, role Role) error {
+	if !role.Valid() {
+		return InvalidRoleError
+	}
+	_, err := s.GetMemberFromCollection(slug, user)
+	if err != nil && err != MemberNotFoundError {
+		return err
+	}
+	query := addMemberToCollectionSQL(slug, user, role)
+	if err == nil {
+		query = updateMemberSQL(slug, user, role)
+	}
+	_, err = (*sql.DB)(s).Exec(query.String(), query.Args...)
+	return err
+}
+
+func getMemberFromCollectionSQL(slug, user string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT role FROM "+memberTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("user_id=?", user)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) GetMemberFromCollection(slug, user string) (Role, error) {
+	_, err := s.GetCollectionData(slug)
+	if err != nil {
+		return "", err
+	}
+	query := getMemberFromCollectionSQL(slug, user)
+	var role string
+	err = (*sql.DB)(s).QueryRow(query.String(), query.Args...).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", MemberNotFoundError
+	}
+	return Role(role), err
+}
+
+func getCollectionMembersSQL(slug string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT user_id, role FROM "+memberTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) GetCollectionMembers(slug string) (map[string]Role, error) {
+	_, err := s.GetCollectionData(slug)
+	if err != nil {
+		return map[string]Role{}, err
+	}
+	query := getCollectionMembersSQL(slug)
+	rows, err := (*sql.DB)(s).Query(query.String(), query.Args...)
+	if err != nil {
+		return map[string]Role{}, err
+	}
+	defer rows.Close()
+	members := map[string]Role{}
+	for rows.Next() {
+		var user, role string
+		err = rows.Scan(&user, &role)
+		if err != nil {
+			return map[string]Role{}, err
+		}
+		members[user] = Role(role)
+	}
+	err = rows.Err()
+	if err != nil {
+		return map[string]Role{}, err
+	}
+	return members, nil
+}
+
+func removeMemberFromCollectionSQL(slug, user string) *pan.Query {
+	query := pan.New(pan.MYSQL, "DELETE FROM "+memberTable)
+	query.IncludeWhere()
+	query.Include("collection=?", slug)
+	query.Include("user_id=?", user)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) RemoveMemberFromCollection(slug, user string) error {
+	_, err := s.GetCollectionData(slug)
+	if err != nil {
+		return err
+	}
+	query := removeMemberFromCollectionSQL(slug, user)
+	res, err := (*sql.DB)(s).Exec(query.String(), query.Args...)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows < 1 {
+		return MemberNotFoundError
+	}
+	return nil
+}
+
+func countBlobReferencesSQL(bucket, blob string) *pan.Query {
+	query := pan.New(pan.MYSQL, "SELECT COUNT(*) FROM "+itemTable)
+	query.IncludeWhere()
+	query.Include("bucket=?", bucket)
+	query.Include("(sha=? OR original_blob=?)", blob, blob)
+	return query.FlushExpressions(" AND ")
+}
+
+func (s *SQLStore) CountBlobReferences(bucket, blob string) (int, error) {
+	query := countBlobReferencesSQL(bucket, blob)
+	var n int
+	err := (*sql.DB)(s).QueryRow(query.String(), query.Args...).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,216 @@
+package api_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"secondbit.org/gifs/api"
+	"secondbit.org/gifs/api/datastoretest"
+)
+
+// The SQLStore tests drop and recreate their tables, so they only run
+// against a throwaway MySQL database named by GIFS_TEST_MYSQL_DSN. Without
+// one, they run against an in-memory SQLite database instead, which can't
+// check the parts of Init that only MySQL needs.
+var sqlTestTables = []string{"collections", "items", "members", "aliases"}
+
+func openTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("GIFS_TEST_MYSQL_DSN")
+	if dsn == "" {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every connection would get its own empty database
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, table := range sqlTestTables {
+		_, err = db.Exec("DROP TABLE IF EXISTS " + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func isSQLite(db *sql.DB) bool {
+	_, ok := db.Driver().(*sqlite3.SQLiteDriver)
+	return ok
+}
+
+func TestSQLStore(t *testing.T) {
+	datastoretest.RunDatastoreTests(t, func(t *testing.T) api.Datastore {
+		s := (*api.SQLStore)(openTestDB(t))
+		err := s.Init("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func hasIndex(t *testing.T, db *sql.DB, table, name string) bool {
+	query := "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?"
+	args := []interface{}{table, name}
+	if isSQLite(db) {
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?"
+	}
+	var n int
+	err := db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+// migratedColumns are the columns Init adds to the first release's tables.
+var migratedColumns = map[string][]string{
+	"collections": {"owner", "visibility"},
+	"items":       {"width", "height", "frames", "duration", "loop_count", "size", "original_size", "original_blob", "original_type", "uploader"},
+}
+
+// TestSQLStoreMigrations starts from the tables the first release created,
+// and makes sure Init brings them up to date without losing anything.
+func TestSQLStoreMigrations(t *testing.T) {
+	db := openTestDB(t)
+	setup := []string{
+		"CREATE TABLE collections (slug VARCHAR(32), name VARCHAR(64))",
+		"CREATE TABLE items (tag VARCHAR(32), collection VARCHAR(32), sha VARCHAR(64), bucket VARCHAR(64))",
+		"INSERT INTO collections (slug, name) VALUES ('reactions', 'Reactions')",
+		"INSERT INTO items (tag, collection, sha, bucket) VALUES ('wave', 'reactions', 'abc123', 'gifs')",
+	}
+	for _, query := range setup {
+		_, err := db.Exec(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := (*api.SQLStore)(db)
+	err := s.Init("test")
+	if err != nil {
+		t.Fatalf("Error migrating: %s", err)
+	}
+	// running Init again leaves everything as it is
+	err = s.Init("test")
+	if err != nil {
+		t.Fatalf("Error running Init a second time: %s", err)
+	}
+	for table, columns := range migratedColumns {
+		for _, column := range columns {
+			var value interface{}
+			err = db.QueryRow("SELECT " + column + " FROM " + table).Scan(&value)
+			if err != nil {
+				t.Errorf("Error reading %s.%s: %s", table, column, err)
+			}
+		}
+	}
+	if !hasIndex(t, db, "items", "items_uploader") {
+		t.Errorf("Expected items to be indexed by uploader")
+	}
+	coll, err := s.GetCollectionData("reactions")
+	if err != nil || coll.Name != "Reactions" {
+		t.Errorf("Expected the collection to survive, got %+v, %v", coll, err)
+	}
+	item, err := s.GetItemFromCollection("reactions", "wave")
+	if err != nil || item.Blob != "abc123" || item.Bucket != "gifs" {
+		t.Errorf("Expected the item to survive, got %+v, %v", item, err)
+	}
+	items, err := s.GetCollectionItems("reactions")
+	if err != nil || len(items) != 1 {
+		t.Errorf("Expected the collection's item to be listed, got %+v, %v", items, err)
+	}
+	if isSQLite(db) {
+		// Init only adds primary keys on MySQL
+		return
+	}
+	// the tables have primary keys now
+	for _, query := range []string{
+		"INSERT INTO collections (slug, name) VALUES ('reactions', 'Again')",
+		"INSERT INTO items (tag, collection, sha, bucket) VALUES ('wave', 'reactions', 'def456', 'gifs')",
+	} {
+		_, err = db.Exec(query)
+		if err == nil {
+			t.Errorf("Expected %q to fail", query)
+		}
+	}
+}
+
+// TestSQLStoreMigrationDuplicates makes sure Init won't add a primary key to
+// a table with rows it would have to throw away.
+func TestSQLStoreMigrationDuplicates(t *testing.T) {
+	db := openTestDB(t)
+	if isSQLite(db) {
+		t.Skip("Init only adds primary keys on MySQL")
+	}
+	setup := []string{
+		"CREATE TABLE items (tag VARCHAR(32), collection VARCHAR(32), sha VARCHAR(64), bucket VARCHAR(64))",
+		"INSERT INTO items (tag, collection, sha, bucket) VALUES ('wave', 'reactions', 'abc123', 'gifs')",
+		"INSERT INTO items (tag, collection, sha, bucket) VALUES ('wave', 'reactions', 'def456', 'gifs')",
+	}
+	for _, query := range setup {
+		_, err := db.Exec(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := (*api.SQLStore)(db).Init("test")
+	if err != api.DuplicateKeysError {
+		t.Errorf("Expected %v, got %v", api.DuplicateKeysError, err)
+	}
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM items").Scan(&n)
+	if err != nil || n != 2 {
+		t.Errorf("Expected both rows to be kept, got %d, %v", n, err)
+	}
+}
+
+// TestSQLStoreRenameRollsBack makes sure a rename that can't move an
+// item's aliases doesn't leave the item renamed without them.
+func TestSQLStoreRenameRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	s := (*api.SQLStore)(db)
+	err := s.Init("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateCollection("reactions", "Reactions", "alice", api.VisibilityPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.AddItemToCollection("reactions", api.Item{Tag: "wave", Blob: "abc123", Bucket: "gifs"}, api.ConflictReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// aliases can still be read, but moving them to the new tag fails
+	t.Cleanup(func() {
+		db.Exec("DROP VIEW IF EXISTS aliases")
+		db.Exec("DROP TABLE IF EXISTS aliases_data")
+	})
+	for _, query := range []string{
+		"ALTER TABLE aliases RENAME TO aliases_data",
+		"CREATE VIEW aliases AS SELECT DISTINCT collection, alias, tag FROM aliases_data",
+	} {
+		_, err = db.Exec(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.RenameItem("reactions", "wave", "hello")
+	if err == nil {
+		t.Fatal("Expected renaming to fail when its aliases can't be moved")
+	}
+	var tag string
+	err = db.QueryRow("SELECT tag FROM items WHERE collection='reactions'").Scan(&tag)
+	if err != nil || tag != "wave" {
+		t.Errorf("Expected the item to keep its tag, got %q, %v", tag, err)
+	}
+}
@@ -1,19 +1,28 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"code.google.com/p/google-api-go-client/googleapi"
 	"code.google.com/p/google-api-go-client/storage/v1beta2"
 )
 
 var (
-	BucketNotFoundError = errors.New("bucket not found")
-	BlobNotFoundError   = errors.New("blob not found")
+	BucketNotFoundError  = errors.New("bucket not found")
+	BlobNotFoundError    = errors.New("blob not found")
+	InvalidBlobNameError = errors.New("invalid blob name")
 )
 
 type Storage interface {
@@ -23,8 +32,218 @@ type Storage interface {
 	Download(bucket, id string, w io.Writer, c Context) (int64, error)
 }
 
+// publicSetter is implemented by Storage backends that can make an object
+// readable by anyone. Backends without one have no public objects.
+type publicSetter interface {
+	SetPublic(bucket, name string, c Context) error
+}
+
+// moveIntoPlace moves src to dst, making dst readable by anyone if public
+// is set and c.Storage can. Blobs are shared by every collection that has
+// the same content, so a blob that's already public is left that way when
+// a non-public upload lands on it.
+func moveIntoPlace(c Context, srcBucket, src, dstBucket, dst string, public bool) error {
+	err := c.Storage.Move(srcBucket, src, dstBucket, dst, c)
+	if err != nil || !public {
+		return err
+	}
+	if p, ok := c.Storage.(publicSetter); ok {
+		return p.SetPublic(dstBucket, dst, c)
+	}
+	return nil
+}
+
+type ObjectInfo struct {
+	Bucket      string
+	Name        string
+	Size        int64 // -1 when the backend can't report a size up front
+	ContentType string
+	ETag        string
+}
+
+type ObjectStorage interface {
+	Put(ctx context.Context, bucket, name string, r io.Reader) (ObjectInfo, error)
+	Get(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, bucket, name string) (ObjectInfo, error)
+	Copy(ctx context.Context, srcBucket, src, dstBucket, dst string) (ObjectInfo, error)
+	Delete(ctx context.Context, bucket, name string) error
+}
+
+type ObjectStorageProvider interface {
+	ObjectStorage() ObjectStorage
+}
+
+func GetObjectStorage(c Context) ObjectStorage {
+	if p, ok := c.Storage.(ObjectStorageProvider); ok {
+		return p.ObjectStorage()
+	}
+	return NewStorageAdapter(c.Storage, c)
+}
+
+func NewStorageAdapter(s Storage, c Context) ObjectStorage {
+	return storageAdapter{storage: s, c: c}
+}
+
+type storageAdapter struct {
+	storage Storage
+	c       Context
+}
+
+func (s storageAdapter) Put(ctx context.Context, bucket, name string, r io.Reader) (ObjectInfo, error) {
+	counter := &countingReader{r: ctxReader{ctx: ctx, r: r}}
+	errs := make(chan error)
+	done := make(chan struct{})
+	go s.storage.Upload(bucket, name, counter, s.c, errs, done)
+	err := <-errs
+	<-done
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if ctx.Err() != nil {
+		return ObjectInfo{}, ctx.Err()
+	}
+	return ObjectInfo{Bucket: bucket, Name: name, Size: counter.n}, nil
+}
+
+func (s storageAdapter) Get(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.storage.Download(bucket, name, pw, s.c)
+		pw.CloseWithError(err)
+	}()
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pr.CloseWithError(ctx.Err())
+		case <-closed:
+		}
+	}()
+	rc := &pipeReadCloser{Reader: bufio.NewReader(pr), pipe: pr, closed: closed}
+	// Download only reports a missing blob by failing, so wait for the
+	// first byte (or the error) before handing the reader back.
+	_, err := rc.Reader.Peek(1)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return rc, ObjectInfo{Bucket: bucket, Name: name, Size: -1}, nil
+}
+
+var errStatDone = errors.New("stat done")
+
+// statWriter stops a download at its first byte.
+type statWriter struct{}
+
+func (statWriter) Write(p []byte) (int, error) {
+	return 0, errStatDone
+}
+
+// Stat can only find out whether a blob exists through Download, so it stops
+// the download as soon as any data arrives and doesn't report a size.
+func (s storageAdapter) Stat(ctx context.Context, bucket, name string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	_, err := s.storage.Download(bucket, name, statWriter{}, s.c)
+	if err != nil && err != errStatDone {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Bucket: bucket, Name: name, Size: -1}, nil
+}
+
+// Copy streams the blob through this server, because Storage has no way to
+// copy one in place. Storages that can should provide their own
+// ObjectStorage instead.
+func (s storageAdapter) Copy(ctx context.Context, srcBucket, src, dstBucket, dst string) (ObjectInfo, error) {
+	rc, _, err := s.Get(ctx, srcBucket, src)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer rc.Close()
+	return s.Put(ctx, dstBucket, dst, rc)
+}
+
+func (s storageAdapter) Delete(ctx context.Context, bucket, name string) error {
+	return s.storage.Delete(bucket, name)
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type pipeReadCloser struct {
+	*bufio.Reader
+	pipe      *io.PipeReader
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *pipeReadCloser) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return p.pipe.Close()
+}
+
 type GoogleCloudStorage struct {
 	*storage.Service
+	client *http.Client
+}
+
+func (gcs *GoogleCloudStorage) httpClient() *http.Client {
+	if gcs.client == nil {
+		return http.DefaultClient
+	}
+	return gcs.client
+}
+
+func (gcs *GoogleCloudStorage) mediaURL(bucket, id string) string {
+	base := strings.Replace(gcs.BasePath, "https://www.googleapis.com/", "https://www.googleapis.com/download/", 1)
+	return base + "b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(id) + "?alt=media"
+}
+
+func (gcs *GoogleCloudStorage) getMedia(ctx context.Context, bucket, id string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", gcs.mediaURL(bucket, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := gcs.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, gcsError(err)
+	}
+	return resp, nil
+}
+
+func gcsError(err error) error {
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return BlobNotFoundError
+	}
+	return err
 }
 
 func (gcs *GoogleCloudStorage) Upload(bucket, tmp string, r io.Reader, c Context, errs chan error, done chan struct{}) {
@@ -59,23 +278,21 @@ func (gcs *GoogleCloudStorage) Move(srcBucket, src, dstBucket, dst string, c Con
 		return err
 	}
 	log.Printf("%+v\n", obj.Owner)
-	objectAcl := &storage.ObjectAccessControl{
-		Bucket: dstBucket, Entity: "allUsers", Object: dst, Role: "READER",
-	}
-	_, err = gcs.ObjectAccessControls.Insert(dstBucket, dst, objectAcl).Do()
-	if err != nil {
-		return err
-	}
 	go del(srcBucket, src, c)
 	return nil
 }
 
-func (gcs *GoogleCloudStorage) Download(bucket, id string, w io.Writer, c Context) (int64, error) {
-	res, err := gcs.Objects.Get(bucket, id).Do()
-	if err != nil {
-		return 0, err
+// SetPublic makes name readable by anyone.
+func (gcs *GoogleCloudStorage) SetPublic(bucket, name string, c Context) error {
+	objectAcl := &storage.ObjectAccessControl{
+		Bucket: bucket, Entity: "allUsers", Object: name, Role: "READER",
 	}
-	resp, err := http.Get(res.MediaLink)
+	_, err := gcs.ObjectAccessControls.Insert(bucket, name, objectAcl).Do()
+	return err
+}
+
+func (gcs *GoogleCloudStorage) Download(bucket, id string, w io.Writer, c Context) (int64, error) {
+	resp, err := gcs.getMedia(context.Background(), bucket, id)
 	if err != nil {
 		return 0, err
 	}
@@ -83,6 +300,75 @@ func (gcs *GoogleCloudStorage) Download(bucket, id string, w io.Writer, c Contex
 	return io.Copy(w, resp.Body)
 }
 
+func (gcs *GoogleCloudStorage) ObjectStorage() ObjectStorage {
+	return gcsObjects{gcs}
+}
+
+type gcsObjects struct {
+	gcs *GoogleCloudStorage
+}
+
+func gcsObjectInfo(obj *storage.Object) ObjectInfo {
+	return ObjectInfo{
+		Bucket:      obj.Bucket,
+		Name:        obj.Name,
+		Size:        int64(obj.Size),
+		ContentType: obj.ContentType,
+		ETag:        obj.Etag,
+	}
+}
+
+func (g gcsObjects) Put(ctx context.Context, bucket, name string, r io.Reader) (ObjectInfo, error) {
+	obj, err := g.gcs.Objects.Insert(bucket, &storage.Object{Name: name}).Media(ctxReader{ctx: ctx, r: r}).Do()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return gcsObjectInfo(obj), nil
+}
+
+func (g gcsObjects) Get(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error) {
+	resp, err := g.gcs.getMedia(ctx, bucket, name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return resp.Body, ObjectInfo{
+		Bucket:      bucket,
+		Name:        name,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (g gcsObjects) Stat(ctx context.Context, bucket, name string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	obj, err := g.gcs.Objects.Get(bucket, name).Do()
+	if err != nil {
+		return ObjectInfo{}, gcsError(err)
+	}
+	return gcsObjectInfo(obj), nil
+}
+
+func (g gcsObjects) Copy(ctx context.Context, srcBucket, src, dstBucket, dst string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	obj, err := g.gcs.Objects.Copy(srcBucket, src, dstBucket, dst, nil).Do()
+	if err != nil {
+		return ObjectInfo{}, gcsError(err)
+	}
+	return gcsObjectInfo(obj), nil
+}
+
+func (g gcsObjects) Delete(ctx context.Context, bucket, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return gcsError(g.gcs.Objects.Delete(bucket, name).Do())
+}
+
 type Memstorage map[string]Bucket
 
 type Bucket map[string][]byte
@@ -99,7 +385,9 @@ func (m Memstorage) Upload(bucket, tmp string, r io.Reader, c Context, errs chan
 	}
 	bytes, err := ioutil.ReadAll(r)
 	if err != nil {
-		errs <- err
+		if errs != nil {
+			errs <- err
+		}
 		return
 	}
 	m[bucket][tmp] = bytes
@@ -120,6 +408,9 @@ func (m Memstorage) Move(srcBucket, src, dstBucket, dst string, c Context) error
 	if _, ok := m[dstBucket]; !ok {
 		m[dstBucket] = make(Bucket)
 	}
+	if _, ok := m[dstBucket][dst]; ok {
+		return m.Delete(srcBucket, src)
+	}
 	m[dstBucket][dst] = m[srcBucket][src]
 	return m.Delete(srcBucket, src)
 }
@@ -134,3 +425,255 @@ func (m Memstorage) Download(bucket, id string, w io.Writer, c Context) (int64,
 	n, err := w.Write(m[bucket][id])
 	return int64(n), err
 }
+
+func (m Memstorage) ObjectStorage() ObjectStorage {
+	return memObjects{m}
+}
+
+type memObjects struct {
+	m Memstorage
+}
+
+func (o memObjects) Put(ctx context.Context, bucket, name string, r io.Reader) (ObjectInfo, error) {
+	data, err := ioutil.ReadAll(ctxReader{ctx: ctx, r: r})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, ok := o.m[bucket]; !ok {
+		o.m[bucket] = make(Bucket)
+	}
+	o.m[bucket][name] = data
+	return ObjectInfo{Bucket: bucket, Name: name, Size: int64(len(data))}, nil
+}
+
+func (o memObjects) Get(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error) {
+	info, err := o.Stat(ctx, bucket, name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.m[bucket][name])), info, nil
+}
+
+func (o memObjects) Stat(ctx context.Context, bucket, name string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, ok := o.m[bucket]; !ok {
+		return ObjectInfo{}, BucketNotFoundError
+	}
+	data, ok := o.m[bucket][name]
+	if !ok {
+		return ObjectInfo{}, BlobNotFoundError
+	}
+	return ObjectInfo{Bucket: bucket, Name: name, Size: int64(len(data))}, nil
+}
+
+func (o memObjects) Copy(ctx context.Context, srcBucket, src, dstBucket, dst string) (ObjectInfo, error) {
+	if _, err := o.Stat(ctx, srcBucket, src); err != nil {
+		return ObjectInfo{}, err
+	}
+	return o.Put(ctx, dstBucket, dst, bytes.NewReader(o.m[srcBucket][src]))
+}
+
+func (o memObjects) Delete(ctx context.Context, bucket, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return o.m.Delete(bucket, name)
+}
+
+type FilesystemStorage struct {
+	Root string
+}
+
+func (fs FilesystemStorage) path(bucket, name string) (string, error) {
+	if bucket == "" || name == "" {
+		return "", InvalidBlobNameError
+	}
+	for _, part := range strings.Split(bucket+"/"+name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", InvalidBlobNameError
+		}
+	}
+	return filepath.Join(fs.Root, bucket, filepath.FromSlash(name)), nil
+}
+
+func (fs FilesystemStorage) Upload(bucket, tmp string, r io.Reader, c Context, errs chan error, done chan struct{}) {
+	if errs != nil {
+		defer close(errs)
+	}
+	if done != nil {
+		defer close(done)
+	}
+	err := fs.write(bucket, tmp, r)
+	if err != nil && errs != nil {
+		errs <- err
+	}
+}
+
+func (fs FilesystemStorage) write(bucket, name string, r io.Reader) error {
+	path, err := fs.path(bucket, name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (fs FilesystemStorage) Delete(bucket, tmp string) error {
+	path, err := fs.path(bucket, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return BlobNotFoundError
+	}
+	return err
+}
+
+func (fs FilesystemStorage) Move(srcBucket, src, dstBucket, dst string, c Context) error {
+	srcPath, err := fs.path(srcBucket, src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := fs.path(dstBucket, dst)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(srcPath)
+	if os.IsNotExist(err) {
+		return BlobNotFoundError
+	} else if err != nil {
+		return err
+	}
+	_, err = os.Stat(dstPath)
+	if err == nil {
+		return fs.Delete(srcBucket, src)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(srcPath, dstPath)
+}
+
+func (fs FilesystemStorage) Download(bucket, id string, w io.Writer, c Context) (int64, error) {
+	path, err := fs.path(bucket, id)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(fs.Root, bucket)); os.IsNotExist(err) {
+			return 0, BucketNotFoundError
+		}
+		return 0, BlobNotFoundError
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (fs FilesystemStorage) ObjectStorage() ObjectStorage {
+	return fsObjects{fs}
+}
+
+type fsObjects struct {
+	fs FilesystemStorage
+}
+
+func (o fsObjects) Put(ctx context.Context, bucket, name string, r io.Reader) (ObjectInfo, error) {
+	counter := &countingReader{r: ctxReader{ctx: ctx, r: r}}
+	err := o.fs.write(bucket, name, counter)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Bucket: bucket, Name: name, Size: counter.n}, nil
+}
+
+func (o fsObjects) open(bucket, name string) (*os.File, ObjectInfo, error) {
+	path, err := o.fs.path(bucket, name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(o.fs.Root, bucket)); os.IsNotExist(err) {
+			return nil, ObjectInfo{}, BucketNotFoundError
+		}
+		return nil, ObjectInfo{}, BlobNotFoundError
+	} else if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return f, ObjectInfo{Bucket: bucket, Name: name, Size: fi.Size()}, nil
+}
+
+func (o fsObjects) Get(ctx context.Context, bucket, name string) (io.ReadCloser, ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return o.open(bucket, name)
+}
+
+func (o fsObjects) Stat(ctx context.Context, bucket, name string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	f, info, err := o.open(bucket, name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	f.Close()
+	return info, nil
+}
+
+func (o fsObjects) Copy(ctx context.Context, srcBucket, src, dstBucket, dst string) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	f, _, err := o.open(srcBucket, src)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer f.Close()
+	return o.Put(ctx, dstBucket, dst, f)
+}
+
+func (o fsObjects) Delete(ctx context.Context, bucket, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return o.fs.Delete(bucket, name)
+}
@@ -0,0 +1,49 @@
+package api_test
+
+import (
+	"testing"
+
+	"secondbit.org/gifs/api"
+	"secondbit.org/gifs/api/gcstest"
+	"secondbit.org/gifs/api/storagetest"
+)
+
+func TestMemstorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) (api.Storage, func(string, string) bool) {
+		return api.NewMemStorage(), nil
+	})
+}
+
+func TestGoogleCloudStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) (api.Storage, func(string, string) bool) {
+		srv := gcstest.NewServer()
+		t.Cleanup(srv.Close)
+		s, err := api.NewGCSStorageFromClient(srv.Client(), srv.BasePath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, srv.IsPublic
+	})
+}
+
+func TestFilesystemStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) (api.Storage, func(string, string) bool) {
+		s, err := api.NewFilesystemStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, nil
+	})
+}
+
+// legacyStorage hides the ObjectStorage a Storage provides, so the suite
+// runs against the adapter instead.
+type legacyStorage struct {
+	api.Storage
+}
+
+func TestStorageAdapter(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) (api.Storage, func(string, string) bool) {
+		return legacyStorage{api.NewMemStorage()}, nil
+	})
+}
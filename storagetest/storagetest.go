@@ -0,0 +1,353 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"secondbit.org/gifs/api"
+)
+
+const bucket = "gifs"
+
+type Factory func(t *testing.T) (s api.Storage, isPublic func(bucket, name string) bool)
+
+type storageTest func(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool)
+
+var storageTests = []struct {
+	name string
+	test storageTest
+}{
+	{"UploadDownload", testUploadDownload},
+	{"UploadOverwrite", testUploadOverwrite},
+	{"UploadLarge", testUploadLarge},
+	{"Delete", testDelete},
+	{"DownloadNotFound", testDownloadNotFound},
+	{"Move", testMove},
+	{"MoveAcrossBuckets", testMoveAcrossBuckets},
+	{"MoveDestinationExists", testMoveDestinationExists},
+	{"MoveNotFound", testMoveNotFound},
+	{"MoveIsPrivate", testMoveIsPrivate},
+	{"SetPublic", testSetPublic},
+	{"MoveDestinationExistsStaysPublic", testMoveDestinationExistsStaysPublic},
+	{"ObjectStoragePutGet", testObjectStoragePutGet},
+	{"ObjectStorageGetNotFound", testObjectStorageGetNotFound},
+	{"ObjectStorageStat", testObjectStorageStat},
+	{"ObjectStorageCopyDelete", testObjectStorageCopyDelete},
+}
+
+func RunStorageTests(t *testing.T, factory Factory) {
+	for _, st := range storageTests {
+		test := st.test
+		t.Run(st.name, func(t *testing.T) {
+			s, isPublic := factory(t)
+			test(t, s, isPublic)
+		})
+	}
+}
+
+func storageContext(s api.Storage) api.Context {
+	return api.Context{Storage: s, Bucket: bucket}
+}
+
+func mustUpload(t *testing.T, s api.Storage, bucket, name string, data []byte) {
+	errs := make(chan error)
+	done := make(chan struct{})
+	go s.Upload(bucket, name, bytes.NewReader(data), storageContext(s), errs, done)
+	err := <-errs
+	<-done
+	if err != nil {
+		t.Fatalf("Error uploading %s to %s: %s", name, bucket, err)
+	}
+}
+
+func mustDownload(t *testing.T, s api.Storage, bucket, name string) []byte {
+	var buf bytes.Buffer
+	n, err := s.Download(bucket, name, &buf, storageContext(s))
+	if err != nil {
+		t.Fatalf("Error downloading %s from %s: %s", name, bucket, err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("Expected Download to report %d bytes, got %d", buf.Len(), n)
+	}
+	return buf.Bytes()
+}
+
+// Move is allowed to clean up its source asynchronously, so poll for
+// it to disappear instead of checking once.
+func waitForDelete(t *testing.T, s api.Storage, bucket, name string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := s.Download(bucket, name, &bytes.Buffer{}, storageContext(s))
+		if err != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Expected %s in %s to be removed", name, bucket)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testUploadDownload(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	data := []byte("GIF89a not really a gif")
+	mustUpload(t, s, bucket, "tmp/upload", data)
+	got := mustDownload(t, s, bucket, "tmp/upload")
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+}
+
+func testUploadOverwrite(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("first"))
+	mustUpload(t, s, bucket, "tmp/upload", []byte("second"))
+	got := mustDownload(t, s, bucket, "tmp/upload")
+	if string(got) != "second" {
+		t.Errorf("Expected %q, got %q", "second", got)
+	}
+}
+
+func testUploadLarge(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	data := bytes.Repeat([]byte("GIF89a"), 2*1024*1024)
+	mustUpload(t, s, bucket, "tmp/large", data)
+	got := mustDownload(t, s, bucket, "tmp/large")
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %d bytes to round trip, got %d different bytes", len(data), len(got))
+	}
+}
+
+func testDelete(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("delete me"))
+	mustUpload(t, s, bucket, "tmp/keep", []byte("keep me"))
+	err := s.Delete(bucket, "tmp/upload")
+	if err != nil {
+		t.Fatalf("Error deleting: %s", err)
+	}
+	_, err = s.Download(bucket, "tmp/upload", &bytes.Buffer{}, storageContext(s))
+	if err == nil {
+		t.Errorf("Expected an error downloading a deleted blob")
+	}
+	got := mustDownload(t, s, bucket, "tmp/keep")
+	if string(got) != "keep me" {
+		t.Errorf("Expected %q, got %q", "keep me", got)
+	}
+}
+
+func testDownloadNotFound(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("something"))
+	var buf bytes.Buffer
+	_, err := s.Download(bucket, "missing", &buf, storageContext(s))
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written for a missing blob, got %q", buf.Bytes())
+	}
+}
+
+func testMove(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("moving"))
+	err := s.Move(bucket, "tmp/upload", bucket, "final", storageContext(s))
+	if err != nil {
+		t.Fatalf("Error moving: %s", err)
+	}
+	got := mustDownload(t, s, bucket, "final")
+	if string(got) != "moving" {
+		t.Errorf("Expected %q, got %q", "moving", got)
+	}
+	waitForDelete(t, s, bucket, "tmp/upload")
+}
+
+func testMoveAcrossBuckets(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("moving"))
+	err := s.Move(bucket, "tmp/upload", "other", "final", storageContext(s))
+	if err != nil {
+		t.Fatalf("Error moving: %s", err)
+	}
+	got := mustDownload(t, s, "other", "final")
+	if string(got) != "moving" {
+		t.Errorf("Expected %q, got %q", "moving", got)
+	}
+	waitForDelete(t, s, bucket, "tmp/upload")
+}
+
+func testMoveDestinationExists(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/first", []byte("original"))
+	err := s.Move(bucket, "tmp/first", bucket, "final", storageContext(s))
+	if err != nil {
+		t.Fatalf("Error moving: %s", err)
+	}
+	mustUpload(t, s, bucket, "tmp/second", []byte("duplicate"))
+	err = s.Move(bucket, "tmp/second", bucket, "final", storageContext(s))
+	if err != nil {
+		t.Fatalf("Error moving onto an existing blob: %s", err)
+	}
+	got := mustDownload(t, s, bucket, "final")
+	if string(got) != "original" {
+		t.Errorf("Expected existing blob %q to be kept, got %q", "original", got)
+	}
+	waitForDelete(t, s, bucket, "tmp/second")
+}
+
+func testMoveNotFound(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("something"))
+	err := s.Move(bucket, "missing", bucket, "final", storageContext(s))
+	if err == nil {
+		t.Errorf("Expected an error moving a missing blob")
+	}
+	_, err = s.Download(bucket, "final", &bytes.Buffer{}, storageContext(s))
+	if err == nil {
+		t.Errorf("Expected no blob to be created when moving a missing blob")
+	}
+}
+
+// publicSetter is implemented by the Storage backends that have public
+// blobs.
+type publicSetter interface {
+	SetPublic(bucket, name string, c api.Context) error
+}
+
+func mustSetPublic(t *testing.T, s api.Storage, bucket, name string) {
+	p, ok := s.(publicSetter)
+	if !ok {
+		t.Fatalf("Expected Storage with public blobs to have SetPublic")
+	}
+	err := p.SetPublic(bucket, name, storageContext(s))
+	if err != nil {
+		t.Fatalf("Error making %s in %s public: %s", name, bucket, err)
+	}
+}
+
+func testMoveIsPrivate(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	if isPublic == nil {
+		t.Skip("Storage has no notion of public blobs")
+	}
+	mustUpload(t, s, bucket, "tmp/upload", []byte("private"))
+	err := s.Move(bucket, "tmp/upload", bucket, "final", storageContext(s))
+	if err != nil {
+		t.Fatalf("Error moving: %s", err)
+	}
+	if isPublic(bucket, "final") {
+		t.Errorf("Expected moved blob not to be public")
+	}
+	got := mustDownload(t, s, bucket, "final")
+	if string(got) != "private" {
+		t.Errorf("Expected %q, got %q", "private", got)
+	}
+}
+
+func testSetPublic(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	if isPublic == nil {
+		t.Skip("Storage has no notion of public blobs")
+	}
+	mustUpload(t, s, bucket, "final", []byte("public"))
+	if isPublic(bucket, "final") {
+		t.Errorf("Expected upload not to be public")
+	}
+	mustSetPublic(t, s, bucket, "final")
+	if !isPublic(bucket, "final") {
+		t.Errorf("Expected blob to be public")
+	}
+	got := mustDownload(t, s, bucket, "final")
+	if string(got) != "public" {
+		t.Errorf("Expected %q, got %q", "public", got)
+	}
+}
+
+func testMoveDestinationExistsStaysPublic(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	if isPublic == nil {
+		t.Skip("Storage has no notion of public blobs")
+	}
+	mustUpload(t, s, bucket, "tmp/first", []byte("shared"))
+	err := s.Move(bucket, "tmp/first", bucket, "final", storageContext(s))
+	if err != nil {
+		t.Fatalf("Error moving: %s", err)
+	}
+	mustSetPublic(t, s, bucket, "final")
+	mustUpload(t, s, bucket, "tmp/second", []byte("shared"))
+	err = s.Move(bucket, "tmp/second", bucket, "final", storageContext(s))
+	if err != nil {
+		t.Fatalf("Error moving onto an existing blob: %s", err)
+	}
+	if !isPublic(bucket, "final") {
+		t.Errorf("Expected moving onto a public blob to leave it public")
+	}
+}
+
+func testObjectStoragePutGet(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	objects := api.GetObjectStorage(storageContext(s))
+	data := []byte("GIF89a put and get")
+	info, err := objects.Put(context.Background(), bucket, "tmp/put", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error putting: %s", err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Expected Put to report %d bytes, got %d", len(data), info.Size)
+	}
+	rc, info, err := objects.Get(context.Background(), bucket, "tmp/put")
+	if err != nil {
+		t.Fatalf("Error getting: %s", err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+	if info.Size != -1 && info.Size != int64(len(data)) {
+		t.Errorf("Expected Get to report %d bytes or -1, got %d", len(data), info.Size)
+	}
+}
+
+func testObjectStorageGetNotFound(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("something"))
+	objects := api.GetObjectStorage(storageContext(s))
+	_, _, err := objects.Get(context.Background(), bucket, "missing")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
+
+func testObjectStorageStat(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("something"))
+	objects := api.GetObjectStorage(storageContext(s))
+	info, err := objects.Stat(context.Background(), bucket, "tmp/upload")
+	if err != nil {
+		t.Fatalf("Error statting: %s", err)
+	}
+	if info.Size != -1 && info.Size != int64(len("something")) {
+		t.Errorf("Expected Stat to report %d bytes or -1, got %d", len("something"), info.Size)
+	}
+	_, err = objects.Stat(context.Background(), bucket, "missing")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
+
+func testObjectStorageCopyDelete(t *testing.T, s api.Storage, isPublic func(bucket, name string) bool) {
+	mustUpload(t, s, bucket, "tmp/upload", []byte("copy me"))
+	objects := api.GetObjectStorage(storageContext(s))
+	_, err := objects.Copy(context.Background(), bucket, "tmp/upload", bucket, "copied")
+	if err != nil {
+		t.Fatalf("Error copying: %s", err)
+	}
+	if got := mustDownload(t, s, bucket, "tmp/upload"); string(got) != "copy me" {
+		t.Errorf("Expected source to be kept, got %q", got)
+	}
+	if got := mustDownload(t, s, bucket, "copied"); string(got) != "copy me" {
+		t.Errorf("Expected %q, got %q", "copy me", got)
+	}
+	err = objects.Delete(context.Background(), bucket, "copied")
+	if err != nil {
+		t.Fatalf("Error deleting: %s", err)
+	}
+	_, err = objects.Stat(context.Background(), bucket, "copied")
+	if err != api.BlobNotFoundError {
+		t.Errorf("Expected %v, got %v", api.BlobNotFoundError, err)
+	}
+}
@@ -0,0 +1,471 @@
+package api
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// MaxTransformSize is the largest width or height a GIF can be resized to.
+const MaxTransformSize = 2048
+
+var InvalidTransformError = errors.New("invalid transformation")
+
+// Transform describes a derived version of a GIF. The zero value leaves the
+// GIF unchanged. Steps are applied in the order the fields are listed. If
+// only one of Width and Height is set, the other keeps the aspect ratio.
+type Transform struct {
+	Crop      image.Rectangle // in the source GIF's coordinates
+	Width     int
+	Height    int
+	FPS       int // frames are dropped to stay at or under this rate
+	MaxFrames int
+	Reverse   bool
+	Speed     float64 // delays are divided by this
+}
+
+var transformParams = []string{"crop", "width", "height", "fps", "max_frames", "reverse", "speed"}
+
+// ParseTransform reads a Transform from query parameters. The bool is false
+// if the query doesn't ask for any transformation.
+func ParseTransform(query url.Values) (Transform, bool, error) {
+	var t Transform
+	found := false
+	for _, param := range transformParams {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		found = true
+		var err error
+		switch param {
+		case "crop":
+			t.Crop, err = parseCrop(value)
+		case "width":
+			t.Width, err = parseTransformInt(value, 1, MaxTransformSize)
+		case "height":
+			t.Height, err = parseTransformInt(value, 1, MaxTransformSize)
+		case "fps":
+			t.FPS, err = parseTransformInt(value, 1, 100)
+		case "max_frames":
+			t.MaxFrames, err = parseTransformInt(value, 1, math.MaxInt32)
+		case "reverse":
+			t.Reverse, err = strconv.ParseBool(value)
+		case "speed":
+			t.Speed, err = parseSpeed(value)
+		}
+		if err != nil {
+			return Transform{}, false, InvalidTransformError
+		}
+	}
+	return t, found, nil
+}
+
+func parseTransformInt(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, InvalidTransformError
+	}
+	return n, nil
+}
+
+// transformSpeeds are the speeds a GIF can be played at, so there are only
+// so many ways to store a sped up GIF.
+var transformSpeeds = []float64{0.25, 0.5, 0.75, 1, 1.25, 1.5, 2, 2.5, 3, 4}
+
+func parseSpeed(value string) (float64, error) {
+	speed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	for _, allowed := range transformSpeeds {
+		if speed == allowed {
+			return speed, nil
+		}
+	}
+	return 0, InvalidTransformError
+}
+
+// parseCrop reads a crop as x,y,width,height.
+func parseCrop(value string) (image.Rectangle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, InvalidTransformError
+	}
+	var n [4]int
+	for i, part := range parts {
+		var err error
+		n[i], err = strconv.Atoi(part)
+		if err != nil || n[i] < 0 {
+			return image.Rectangle{}, InvalidTransformError
+		}
+	}
+	if n[2] < 1 || n[3] < 1 {
+		return image.Rectangle{}, InvalidTransformError
+	}
+	return image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]), nil
+}
+
+// String returns a canonical form of t, so equivalent transformations of a
+// blob are only stored once.
+func (t Transform) String() string {
+	var parts []string
+	if !t.Crop.Empty() {
+		parts = append(parts, "crop"+strconv.Itoa(t.Crop.Min.X)+","+strconv.Itoa(t.Crop.Min.Y)+","+strconv.Itoa(t.Crop.Dx())+","+strconv.Itoa(t.Crop.Dy()))
+	}
+	if t.Width > 0 {
+		parts = append(parts, "w"+strconv.Itoa(t.Width))
+	}
+	if t.Height > 0 {
+		parts = append(parts, "h"+strconv.Itoa(t.Height))
+	}
+	if t.FPS > 0 {
+		parts = append(parts, "fps"+strconv.Itoa(t.FPS))
+	}
+	if t.MaxFrames > 0 {
+		parts = append(parts, "max"+strconv.Itoa(t.MaxFrames))
+	}
+	if t.Reverse {
+		parts = append(parts, "rev")
+	}
+	if t.Speed > 0 && t.Speed != 1 {
+		parts = append(parts, "speed"+strconv.FormatFloat(t.Speed, 'f', -1, 64))
+	}
+	return strings.Join(parts, "-")
+}
+
+// canonical returns the simplest Transform that does the same to item as t
+// does, so a rendition is only made and stored under one name. Crops are
+// clipped to the item, and sizes, frame limits and frame rates that make
+// no difference are dropped. Crops that miss the item entirely fail with
+// InvalidTransformError. Items without a recorded size only get the parts
+// that don't depend on it tidied up.
+func (t Transform) canonical(item Item) (Transform, error) {
+	if t.FPS > 0 {
+		t.FPS = 100 / (100 / t.FPS)
+	}
+	if t.Speed == 1 {
+		t.Speed = 0
+	}
+	if item.Frames > 0 && t.MaxFrames >= item.Frames {
+		t.MaxFrames = 0
+	}
+	if item.Width <= 0 || item.Height <= 0 {
+		return t, nil
+	}
+	bounds := image.Rect(0, 0, item.Width, item.Height)
+	crop := bounds
+	if !t.Crop.Empty() {
+		crop = t.Crop.Intersect(bounds)
+		if crop.Empty() {
+			return Transform{}, InvalidTransformError
+		}
+	}
+	t.Crop = crop
+	if crop == bounds {
+		t.Crop = image.Rectangle{}
+	}
+	t.Width, t.Height = t.outputSize(crop.Dx(), crop.Dy())
+	if t.Width == crop.Dx() && t.Height == crop.Dy() {
+		t.Width, t.Height = 0, 0
+	}
+	return t, nil
+}
+
+// Renditions of a blob are kept together under renditionPrefix, so they
+// can be found and removed along with it.
+const renditionPrefix = "renditions/"
+
+// renditionName is where the rendition of blob with t applied, in the
+// format ext is the extension of, is stored.
+func renditionName(blob string, t Transform, ext string) string {
+	name := t.String()
+	if name == "" {
+		name = "untransformed"
+	}
+	return renditionPrefix + blob + "/" + name + ext
+}
+
+func transformedName(blob string, t Transform) string {
+	return renditionName(blob, t, ".gif")
+}
+
+// cacheable reports whether renditions made with t are stored. Only
+// reversed and sped up renditions are, so there are few enough of them
+// for all of a blob's renditions to be removed with it.
+func (t Transform) cacheable() bool {
+	return t.Crop.Empty() && t.Width == 0 && t.Height == 0 && t.FPS == 0 && t.MaxFrames == 0
+}
+
+// cacheableTransforms returns every canonical Transform that's cacheable,
+// starting with the zero Transform.
+func cacheableTransforms() []Transform {
+	var transforms []Transform
+	for _, reverse := range []bool{false, true} {
+		transforms = append(transforms, Transform{Reverse: reverse})
+		for _, speed := range transformSpeeds {
+			if speed != 1 {
+				transforms = append(transforms, Transform{Reverse: reverse, Speed: speed})
+			}
+		}
+	}
+	return transforms
+}
+
+// renditionNames are the names every stored rendition of blob could have.
+func renditionNames(blob string) []string {
+	var names []string
+	for _, t := range cacheableTransforms() {
+		if t != (Transform{}) {
+			names = append(names, transformedName(blob, t))
+		}
+		names = append(names, apngName(blob, t))
+	}
+	return names
+}
+
+// Apply returns a new GIF with t applied to g. It fails with
+// PartTooLargeError if g, or what g would be turned into, has frames that
+// come to more than MaxGIFPixels.
+func (t Transform) Apply(g *gif.GIF) (*gif.GIF, error) {
+	bounds := gifBounds(g)
+	crop := bounds
+	if !t.Crop.Empty() {
+		crop = t.Crop.Intersect(bounds)
+		if crop.Empty() {
+			return nil, InvalidTransformError
+		}
+	}
+	width, height := t.outputSize(crop.Dx(), crop.Dy())
+	if int64(width)*int64(height)*int64(len(g.Image)) > MaxGIFPixels {
+		return nil, PartTooLargeError
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	var scaled *image.RGBA
+	if width != crop.Dx() || height != crop.Dy() {
+		scaled = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	out, err := flattenFrames(g, nil, func(canvas *image.RGBA) *image.RGBA {
+		draw.Draw(cropped, cropped.Bounds(), canvas, crop.Min, draw.Src)
+		if scaled == nil {
+			return cropped
+		}
+		draw.BiLinear.Scale(scaled, scaled.Bounds(), cropped, cropped.Bounds(), draw.Src, nil)
+		return scaled
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.FPS > 0 {
+		out.Image, out.Delay = dropFrames(out.Image, out.Delay, 100/t.FPS)
+	}
+	if t.MaxFrames > 0 && len(out.Image) > t.MaxFrames {
+		out.Image = out.Image[:t.MaxFrames]
+		out.Delay = out.Delay[:t.MaxFrames]
+	}
+	if t.Reverse {
+		for i, j := 0, len(out.Image)-1; i < j; i, j = i+1, j-1 {
+			out.Image[i], out.Image[j] = out.Image[j], out.Image[i]
+			out.Delay[i], out.Delay[j] = out.Delay[j], out.Delay[i]
+		}
+	}
+	if t.Speed > 0 && t.Speed != 1 {
+		for i, delay := range out.Delay {
+			if delay == 0 {
+				continue
+			}
+			delay = int(math.Floor(float64(delay)/t.Speed + 0.5))
+			// most browsers slow down GIFs with delays shorter than this
+			if delay < 2 {
+				delay = 2
+			}
+			out.Delay[i] = delay
+		}
+	}
+	return out, nil
+}
+
+// outputSize works out the size of a w by h image after resizing. Sizes
+// worked out from the aspect ratio are kept within MaxTransformSize.
+func (t Transform) outputSize(w, h int) (int, int) {
+	switch {
+	case t.Width > 0 && t.Height > 0:
+		return t.Width, t.Height
+	case t.Width > 0:
+		return t.Width, clampSize(h * t.Width / w)
+	case t.Height > 0:
+		return clampSize(w * t.Height / h), t.Height
+	}
+	return w, h
+}
+
+func clampSize(n int) int {
+	if n > MaxTransformSize {
+		return MaxTransformSize
+	}
+	return maxInt(1, n)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func gifBounds(g *gif.GIF) image.Rectangle {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	return bounds
+}
+
+// flattenFrames draws each frame of g over the frames before it, the way a
+// browser would, and builds a new GIF out of what render makes of each
+// result. render mustn't hang on to the canvas it's given. Every frame of
+// the new GIF covers the whole image, so frames can be dropped or
+// reordered freely. Any extra colors are added to the new frames'
+// palettes if they fit.
+func flattenFrames(g *gif.GIF, extra []color.Color, render func(canvas *image.RGBA) *image.RGBA) (*gif.GIF, error) {
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	err := compositeFrames(g, func(i int, canvas *image.RGBA) {
+		src := render(canvas)
+		paletted := image.NewPaletted(src.Bounds(), withColors(flatPalette(g, g.Image[i], src), extra))
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), src, src.Bounds().Min)
+		out.Image = append(out.Image, paletted)
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		out.Delay = append(out.Delay, delay)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// fitsFlattened reports whether every frame of g, drawn at the size of the
+// whole GIF, comes to no more than MaxGIFPixels.
+func fitsFlattened(g *gif.GIF) bool {
+	bounds := gifBounds(g)
+	area := int64(bounds.Dx()) * int64(bounds.Dy())
+	return area <= MaxGIFPixels && area*int64(len(g.Image)) <= MaxGIFPixels
+}
+
+// compositeFrames draws each frame of g over the frames before it, the way
+// a browser would, and calls fn with the result. fn mustn't hang on to the
+// canvas it's given. GIFs that don't fitsFlattened fail with
+// PartTooLargeError before anything is drawn.
+func compositeFrames(g *gif.GIF, fn func(i int, canvas *image.RGBA)) error {
+	if !fitsFlattened(g) {
+		return PartTooLargeError
+	}
+	bounds := gifBounds(g)
+	canvas := image.NewRGBA(bounds)
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		fn(i, canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return nil
+}
+
+// withColors adds the colors p doesn't already have, as long as there's
+// room for them.
+func withColors(p color.Palette, colors []color.Color) color.Palette {
+	for _, c := range colors {
+		if len(p) >= 256 {
+			break
+		}
+		if p.Convert(c) != c {
+			p = append(p[:len(p):len(p)], c)
+		}
+	}
+	return p
+}
+
+// flatPalette is the palette a flattened frame is quantized to. If the
+// frame has few enough colors, they're used as is. Otherwise the frame's
+// own palette is used, unless it only covers part of the frame's colors,
+// like in GIFs where frames only hold what changed since the frame before.
+func flatPalette(g *gif.GIF, frame *image.Paletted, flat *image.RGBA) color.Palette {
+	if p, ok := exactPalette(flat); ok {
+		return p
+	}
+	if len(frame.Palette) == 256 {
+		return frame.Palette
+	}
+	if global, ok := g.Config.ColorModel.(color.Palette); ok && len(global) == 256 {
+		return global
+	}
+	return palette.Plan9
+}
+
+// exactPalette returns the colors img uses, or false if there are more
+// than fit in a GIF's palette.
+func exactPalette(img *image.RGBA) (color.Palette, bool) {
+	var p color.Palette
+	seen := map[color.RGBA]bool{}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if seen[c] {
+				continue
+			}
+			if len(p) == 256 {
+				return nil, false
+			}
+			seen[c] = true
+			p = append(p, c)
+		}
+	}
+	return p, true
+}
+
+// dropFrames keeps frames at least minDelay hundredths of a second apart.
+// Dropped frames add their delay to the frame before them, so the GIF takes
+// as long to play as it did before.
+func dropFrames(frames []*image.Paletted, delays []int, minDelay int) ([]*image.Paletted, []int) {
+	var keptFrames []*image.Paletted
+	var keptDelays []int
+	for i, frame := range frames {
+		last := len(keptFrames) - 1
+		if last >= 0 && keptDelays[last] < minDelay {
+			keptDelays[last] += delays[i]
+			continue
+		}
+		keptFrames = append(keptFrames, frame)
+		keptDelays = append(keptDelays, delays[i])
+	}
+	return keptFrames, keptDelays
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/url"
+	"testing"
+)
+
+func TestParseTransform(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected Transform
+		found    bool
+		err      error
+	}{
+		{"", Transform{}, false, nil},
+		{"width=20&crop=1,2,3,4", Transform{Width: 20, Crop: image.Rect(1, 2, 4, 6)}, true, nil},
+		{"speed=2.5&reverse=true", Transform{Speed: 2.5, Reverse: true}, true, nil},
+		{"speed=1", Transform{Speed: 1}, true, nil},
+		{"speed=2.4", Transform{}, false, InvalidTransformError},
+		{"speed=1.0000001", Transform{}, false, InvalidTransformError},
+		{"width=0", Transform{}, false, InvalidTransformError},
+		{"width=4096", Transform{}, false, InvalidTransformError},
+		{"crop=1,2,3", Transform{}, false, InvalidTransformError},
+		{"crop=1,2,0,4", Transform{}, false, InvalidTransformError},
+	}
+	for _, tc := range cases {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transform, found, err := ParseTransform(query)
+		if err != tc.err || found != tc.found || transform != tc.expected {
+			t.Errorf("Expected %q to parse as %+v, %v, %v, got %+v, %v, %v", tc.query, tc.expected, tc.found, tc.err, transform, found, err)
+		}
+	}
+}
+
+func TestTransformCanonical(t *testing.T) {
+	item := Item{Metadata: Metadata{Width: 40, Height: 20, Frames: 6}}
+	cases := []struct {
+		transform Transform
+		expected  Transform
+	}{
+		{Transform{Width: 20}, Transform{Width: 20, Height: 10}},
+		{Transform{Height: 10}, Transform{Width: 20, Height: 10}},
+		{Transform{Width: 40}, Transform{}},
+		{Transform{Crop: image.Rect(0, 0, 100, 100)}, Transform{}},
+		{Transform{Crop: image.Rect(30, 10, 100, 100)}, Transform{Crop: image.Rect(30, 10, 40, 20)}},
+		{Transform{Crop: image.Rect(30, 10, 100, 100), Width: 10}, Transform{Crop: image.Rect(30, 10, 40, 20)}},
+		{Transform{FPS: 40}, Transform{FPS: 50}},
+		{Transform{FPS: 10}, Transform{FPS: 10}},
+		{Transform{MaxFrames: 6}, Transform{}},
+		{Transform{MaxFrames: 5}, Transform{MaxFrames: 5}},
+		{Transform{Speed: 1}, Transform{}},
+	}
+	for _, tc := range cases {
+		canonical, err := tc.transform.canonical(item)
+		if err != nil {
+			t.Errorf("Error making %+v canonical: %s", tc.transform, err)
+		} else if canonical != tc.expected {
+			t.Errorf("Expected %+v to be canonical as %+v, got %+v", tc.transform, tc.expected, canonical)
+		}
+	}
+	_, err := Transform{Crop: image.Rect(50, 50, 60, 60)}.canonical(item)
+	if err != InvalidTransformError {
+		t.Errorf("Expected a crop outside the item to fail with %v, got %v", InvalidTransformError, err)
+	}
+	// without a size, crops and sizes can't be checked
+	canonical, err := Transform{Width: 20, Crop: image.Rect(0, 0, 100, 100)}.canonical(Item{})
+	if err != nil || canonical != (Transform{Width: 20, Crop: image.Rect(0, 0, 100, 100)}) {
+		t.Errorf("Expected an item without a size to keep its crop and size, got %+v, %v", canonical, err)
+	}
+}
+
+func TestTransformOutputSize(t *testing.T) {
+	cases := []struct {
+		transform     Transform
+		width, height int
+	}{
+		{Transform{}, 40, 20},
+		{Transform{Width: 20}, 20, 10},
+		{Transform{Height: 5}, 10, 5},
+		{Transform{Width: 10, Height: 30}, 10, 30},
+		{Transform{Width: 1}, 1, 1},
+		{Transform{Height: MaxTransformSize}, MaxTransformSize, MaxTransformSize},
+	}
+	for _, tc := range cases {
+		width, height := tc.transform.outputSize(40, 20)
+		if width != tc.width || height != tc.height {
+			t.Errorf("Expected %+v to make 40x20 %dx%d, got %dx%d", tc.transform, tc.width, tc.height, width, height)
+		}
+	}
+	width, height := Transform{Width: MaxTransformSize}.outputSize(1, 1000)
+	if width != MaxTransformSize || height != MaxTransformSize {
+		t.Errorf("Expected a tall GIF to be kept within %d, got %dx%d", MaxTransformSize, width, height)
+	}
+}
+
+func TestTransformApply(t *testing.T) {
+	src := &gif.GIF{LoopCount: 2, Config: image.Config{Width: 40, Height: 20}}
+	for i := 0; i < 6; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), color.Palette{color.Black, color.RGBA{uint8(i * 40), 0, 0, 255}})
+		for j := range frame.Pix {
+			frame.Pix[j] = 1
+		}
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 5)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(encodedGIF(t, src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		transform     Transform
+		width, height int
+		delays        []int
+		firstRed      uint32
+	}{
+		{Transform{}, 40, 20, []int{5, 5, 5, 5, 5, 5}, 0},
+		{Transform{Width: 20}, 20, 10, []int{5, 5, 5, 5, 5, 5}, 0},
+		{Transform{Crop: image.Rect(10, 5, 18, 9), Height: 8}, 16, 8, []int{5, 5, 5, 5, 5, 5}, 0},
+		{Transform{FPS: 10}, 40, 20, []int{10, 10, 10}, 0},
+		{Transform{MaxFrames: 2, Speed: 2.5}, 40, 20, []int{2, 2}, 0},
+		{Transform{Reverse: true}, 40, 20, []int{5, 5, 5, 5, 5, 5}, 200},
+		{Transform{Speed: 0.5}, 40, 20, []int{10, 10, 10, 10, 10, 10}, 0},
+	}
+	for _, tc := range cases {
+		out, err := tc.transform.Apply(g)
+		if err != nil {
+			t.Errorf("Error applying %+v: %s", tc.transform, err)
+			continue
+		}
+		decoded, err := gif.DecodeAll(bytes.NewReader(encodedGIF(t, out)))
+		if err != nil {
+			t.Errorf("Error decoding %+v: %s", tc.transform, err)
+			continue
+		}
+		if decoded.Config.Width != tc.width || decoded.Config.Height != tc.height {
+			t.Errorf("Expected %+v to be %dx%d, got %dx%d", tc.transform, tc.width, tc.height, decoded.Config.Width, decoded.Config.Height)
+		}
+		if len(decoded.Delay) != len(tc.delays) {
+			t.Errorf("Expected %+v to have delays %v, got %v", tc.transform, tc.delays, decoded.Delay)
+		} else {
+			for i := range tc.delays {
+				if decoded.Delay[i] != tc.delays[i] {
+					t.Errorf("Expected %+v to have delays %v, got %v", tc.transform, tc.delays, decoded.Delay)
+					break
+				}
+			}
+		}
+		if decoded.LoopCount != 2 {
+			t.Errorf("Expected %+v to keep the loop count, got %d", tc.transform, decoded.LoopCount)
+		}
+		r, _, _, _ := decoded.Image[0].At(0, 0).RGBA()
+		if r>>8 != tc.firstRed {
+			t.Errorf("Expected %+v to start with red %d, got %d", tc.transform, tc.firstRed, r>>8)
+		}
+	}
+
+	_, err = Transform{Crop: image.Rect(50, 50, 60, 60)}.Apply(g)
+	if err != InvalidTransformError {
+		t.Errorf("Expected a crop outside the GIF to fail with %v, got %v", InvalidTransformError, err)
+	}
+}
+
+func TestTransformApplyTooManyColors(t *testing.T) {
+	// the first frame uses 256 colors, and the second adds one more, so
+	// the flattened second frame has 257
+	var full color.Palette
+	for i := 0; i < 256; i++ {
+		full = append(full, color.RGBA{uint8(i), uint8(255 - i), 0, 255})
+	}
+	first := image.NewPaletted(image.Rect(0, 0, 16, 16), full)
+	for i := range first.Pix {
+		first.Pix[i] = uint8(i)
+	}
+	second := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.RGBA{0, 0, 255, 255}})
+	g := &gif.GIF{
+		Image:  []*image.Paletted{first, second},
+		Delay:  []int{10, 10},
+		Config: image.Config{Width: 16, Height: 16},
+	}
+	out, err := Transform{Reverse: true}.Apply(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range out.Image {
+		if len(frame.Palette) > 256 {
+			t.Errorf("Expected frame %d to have at most 256 colors, got %d", i, len(frame.Palette))
+		}
+	}
+	err = gif.EncodeAll(&bytes.Buffer{}, out)
+	if err != nil {
+		t.Errorf("Error encoding a GIF with 257 colors flattened: %s", err)
+	}
+}
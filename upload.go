@@ -1,110 +1,213 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"image"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 
 	"code.google.com/p/go-uuid/uuid"
 )
 
-func Upload(id, collection, tag string, r io.Reader, c Context) (string, error) {
-	hashReader, hashWriter := io.Pipe()
-	uploadReader, uploadWriter := io.Pipe()
-	m := io.MultiWriter(hashWriter, uploadWriter)
+// http.DetectContentType never looks at more than this many bytes.
+const sniffLen = 512
 
-	hashChan := make(chan string)
-	hashError := make(chan error)
-	hashDone := make(chan struct{})
-
-	cpDone := make(chan struct{})
-	cpErr := make(chan error)
-
-	uploadDone := make(chan struct{})
-	uploadErr := make(chan error)
+// Upload stores r as a blob and adds it to collection under tag.
+func Upload(ctx context.Context, id string, collection Collection, tag string, policy ConflictPolicy, r io.Reader, c Context) (Item, ObjectInfo, error) {
+	if !policy.Valid() {
+		return Item{}, ObjectInfo{}, InvalidConflictPolicyError
+	}
+	if !validTag(tag) {
+		return Item{}, ObjectInfo{}, InvalidTagError
+	}
+	// Don't bother storing a blob we already know will be rejected. The
+	// datastore still has the final say, in case the tag is taken while
+	// we're uploading.
+	var replacing int64
+	if policy != ConflictRename && c.Datastore != nil {
+		existing, err := c.Datastore.GetItemFromCollection(collection.Slug, tag)
+		if err == nil && policy == ConflictReject {
+			return Item{}, ObjectInfo{}, TagExistsError
+		} else if err == nil && existing.Uploader == id {
+			replacing = existing.Size
+		} else if err != nil && err != BlobNotFoundError {
+			return Item{}, ObjectInfo{}, err
+		}
+	}
+	limit, limitErr := c.uploadLimit(id, replacing)
+	limited := &limitedReader{r: r, n: limit, err: limitErr}
+	buffered := bufio.NewReaderSize(limited, sniffLen)
+	sniffed, err := buffered.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return Item{}, ObjectInfo{}, err
+	}
+	contentType := http.DetectContentType(sniffed)
+	if !c.allowsType(contentType) {
+		return Item{}, ObjectInfo{}, UnsupportedTypeError
+	}
+	// Animations in other formats are converted before they're hashed, so
+	// animated blobs are always GIFs.
+	var src io.Reader = buffered
+	var original []byte
+	originalType := contentType
+	if convertible(contentType) {
+		header, animated, err := readAnimationHeader(contentType, buffered)
+		if limited.exceeded != nil {
+			return Item{}, ObjectInfo{}, limited.exceeded
+		}
+		if err != nil {
+			return Item{}, ObjectInfo{}, err
+		}
+		if !animated {
+			return Item{}, ObjectInfo{}, StillImageError
+		}
+		capped := &limitedReader{r: io.MultiReader(bytes.NewReader(header), buffered), n: MaxConvertedSize, err: PartTooLargeError}
+		original, err = ioutil.ReadAll(capped)
+		if capped.exceeded != nil {
+			return Item{}, ObjectInfo{}, capped.exceeded
+		}
+		if err != nil {
+			return Item{}, ObjectInfo{}, err
+		}
+		converted, err := convertedUpload(ctx, contentType, original)
+		if err != nil {
+			return Item{}, ObjectInfo{}, err
+		}
+		src = bytes.NewReader(converted)
+		contentType = "image/gif"
+	}
 
-	n := make(chan int64)
+	h := sha1.New()
+	var w io.Writer = h
+	v := newValidator(contentType, c.OptimizeUploads)
+	if v != nil {
+		w = io.MultiWriter(h, v)
+	}
+	tee := io.TeeReader(src, w)
 
 	var bytesWritten int64
 	tmp := uuid.NewRandom().String()
 	tmp = "tmp/" + tmp
 
-	go hash(hashReader, hashChan, hashError, hashDone)
-	go asyncCopy(m, r, n, cpErr, cpDone)
 	if c.Storage != nil {
-		go c.Storage.Upload(c.Bucket, tmp, uploadReader, c, uploadErr, uploadDone)
+		var info ObjectInfo
+		info, err = GetObjectStorage(c).Put(ctx, c.Bucket, tmp, tee)
+		bytesWritten = info.Size
+	} else {
+		bytesWritten, err = io.Copy(ioutil.Discard, tee)
 	}
-
-	select {
-	case err := <-hashError:
-		if err != nil {
-			hashWriter.CloseWithError(err)
-			uploadWriter.CloseWithError(err)
-			return "", err
-		} else {
-			hashWriter.Close()
-			uploadWriter.Close()
-		}
-	case err := <-cpErr:
-		if err != nil {
-			hashWriter.CloseWithError(err)
-			uploadWriter.CloseWithError(err)
-			return "", err
-		} else {
-			hashWriter.Close()
-			uploadWriter.Close()
+	var metadata Metadata
+	var poster image.Image
+	if v != nil {
+		var verr error
+		metadata, verr = v.finish(err)
+		poster = v.poster
+		if err == nil && verr != nil {
+			if c.Storage != nil {
+				del(c.Bucket, tmp, c)
+			}
+			return Item{}, ObjectInfo{}, verr
 		}
-	case err := <-uploadErr:
-		if err != nil {
-			hashWriter.CloseWithError(err)
-			uploadWriter.CloseWithError(err)
-			return "", err
-		} else {
-			hashWriter.Close()
-			uploadWriter.Close()
+	}
+	if limited.exceeded != nil {
+		if c.Storage != nil {
+			del(c.Bucket, tmp, c)
 		}
-	case <-cpDone:
-		hashWriter.Close()
-		uploadWriter.Close()
+		return Item{}, ObjectInfo{}, limited.exceeded
 	}
-	<-cpDone
-	<-hashDone
-	if c.Storage != nil {
-		<-uploadDone
+	if err != nil {
+		return Item{}, ObjectInfo{}, err
+	}
+	received := bytesWritten
+	if original != nil {
+		received = int64(len(original))
+	}
+	metadata.Size = bytesWritten
+	metadata.OriginalSize = received
+	finalLocation := blobName(hex.EncodeToString(h.Sum(nil)), collection.listable())
+	if v != nil && v.gif != nil {
+		if data, optimized := optimizedBlob(v.gif, bytesWritten); data != nil {
+			smaller := "tmp/" + uuid.NewRandom().String()
+			if c.Storage != nil {
+				_, err = GetObjectStorage(c).Put(ctx, c.Bucket, smaller, bytes.NewReader(data))
+			}
+			// the original is still good, so fall back to it if the
+			// optimized copy couldn't be stored
+			if err != nil {
+				log.Println("Error storing optimized upload: " + err.Error())
+				del(c.Bucket, smaller, c)
+			} else {
+				if c.Storage != nil {
+					del(c.Bucket, tmp, c)
+				}
+				tmp = smaller
+				sum := sha1.Sum(data)
+				finalLocation = blobName(hex.EncodeToString(sum[:]), collection.listable())
+				metadata = gifMetadata(optimized)
+				metadata.Size = int64(len(data))
+				metadata.OriginalSize = received
+			}
+		}
 	}
-	bytesWritten = <-n
-	finalLocation := <-hashChan
 	if c.Storage != nil {
-		err := c.Storage.Move(c.Bucket, tmp, c.Bucket, finalLocation, c)
+		err := moveIntoPlace(c, c.Bucket, tmp, c.Bucket, finalLocation, collection.listable())
 		if err != nil {
-			return "", err
+			return Item{}, ObjectInfo{}, err
+		}
+		if poster != nil {
+			storePreviews(ctx, c, finalLocation, poster)
+		}
+		if original != nil && c.KeepOriginals {
+			metadata.OriginalBlob, err = storeOriginal(ctx, c, original, collection.listable())
+			if err != nil {
+				removeStoredBlobs(ctx, c, metadata, finalLocation)
+				return Item{}, ObjectInfo{}, err
+			}
+			metadata.OriginalType = originalType
 		}
 	}
+	metadata.Uploader = id
+	item := Item{
+		Blob:     finalLocation,
+		Bucket:   c.Bucket,
+		Tag:      tag,
+		Aliases:  []string{},
+		Metadata: metadata,
+	}
 	if c.Datastore != nil {
-		err := c.Datastore.AddItemToCollection(collection, Item{
-			Blob:   finalLocation,
-			Bucket: c.Bucket,
-			Tag:    tag,
-		})
+		var err error
+		item, err = c.Datastore.AddItemToCollectionWithinQuota(collection.Slug, item, policy, c.UserQuota)
 		if err != nil {
-			return "", err
+			if c.Storage != nil {
+				removeStoredBlobs(ctx, c, metadata, finalLocation)
+			}
+			return Item{}, ObjectInfo{}, err
 		}
 	}
-	uBytes, uRequests := c.UsageTracker.TrackUploads(id)
-	uBytes <- bytesWritten
-	uRequests <- 1
-	return finalLocation, nil
+	return item, ObjectInfo{
+		Bucket:      item.Bucket,
+		Name:        item.Blob,
+		Size:        metadata.Size,
+		ContentType: contentType,
+	}, nil
 }
 
-func hash(r io.Reader, resp chan string, errs chan error, done chan struct{}) {
-	if resp != nil {
-		defer close(resp)
+// removeStoredBlobs cleans up after an upload that was stored but couldn't
+// be added to its collection, leaving alone blobs that other items share.
+func removeStoredBlobs(ctx context.Context, c Context, metadata Metadata, blob string) {
+	if c.Datastore == nil {
+		return
+	}
+	removeUnusedBlob(ctx, c, c.Bucket, blob)
+	if metadata.OriginalBlob != "" {
+		removeUnusedBlob(ctx, c, c.Bucket, metadata.OriginalBlob)
 	}
-	h := sha1.New()
-	go asyncCopy(h, r, nil, errs, done)
-	<-done
-	resp <- hex.EncodeToString(h.Sum(nil))
 }
 
 func del(bucket, tmp string, c Context) {
@@ -113,47 +216,3 @@ func del(bucket, tmp string, c Context) {
 		log.Printf("Error deleting temporary upload %s in %s: %s\n", tmp, bucket, err)
 	}
 }
-
-func asyncCopy(dst io.Writer, src io.Reader, n chan int64, errs chan error, done chan struct{}) {
-	if errs != nil {
-		defer close(errs)
-	}
-	if done != nil {
-		defer close(done)
-	}
-	buf := make([]byte, 32*1024)
-	var written int64
-	var err error
-	for {
-		nr, er := src.Read(buf)
-		if nr > 0 {
-			nw, ew := dst.Write(buf[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er == io.EOF {
-			break
-		}
-		if er != nil {
-			err = er
-			break
-		}
-	}
-	if errs != nil && err != nil {
-		errs <- err
-	}
-	if n != nil {
-		go func(n chan int64, written int64) {
-			n <- written
-		}(n, written)
-	}
-}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	UnsupportedTypeError = errors.New("file type not allowed")
+	CorruptImageError    = errors.New("file is corrupt")
+)
+
+// MaxGIFPixels bounds how much of a GIF is decoded: neither the GIF's
+// width times its height, nor the area of all its frames added together,
+// may be more than this. Decoding a GIF takes a byte for every pixel of
+// every frame, however well they compress.
+const MaxGIFPixels = 1 << 26
+
+// DefaultAllowedTypes is used when a Context doesn't set AllowedTypes. PNG
+// ("image/png"), WebP ("image/webp"), and MP4 ("video/mp4") uploads can be
+// allowed by listing them in AllowedTypes alongside GIFs. PNGs and WebPs
+// are only accepted if they're animated, to be converted to GIFs.
+var DefaultAllowedTypes = []string{"image/gif"}
+
+func (c Context) allowsType(contentType string) bool {
+	allowed := c.AllowedTypes
+	if len(allowed) < 1 {
+		allowed = DefaultAllowedTypes
+	}
+	for _, t := range allowed {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// validator decodes a copy of an upload as it's written, so corrupt files
+// can be caught and metadata collected without reading the upload twice.
+// Types we don't know how to decode are only checked by sniffing.
+type validator struct {
+	w       *io.PipeWriter
+	errs    chan error
+	budget  *gifBudget
+	decoded Metadata
+	poster  image.Image
+	gif     *gif.GIF // only kept if the validator was asked to keep it, and it fitsFlattened
+}
+
+func newValidator(contentType string, keep bool) *validator {
+	if contentType != "image/gif" {
+		return nil
+	}
+	r, w := io.Pipe()
+	v := &validator{w: w, errs: make(chan error, 1), budget: newGIFBudget()}
+	go func() {
+		g, err := gif.DecodeAll(r)
+		// The decoder stops at the GIF trailer, but whatever comes
+		// after it still has to be read or the upload will block.
+		io.Copy(ioutil.Discard, r)
+		if err == nil {
+			// the frames fit, but the screen they're drawn on might not
+			v.poster, err = posterFrame(g)
+		}
+		if err == nil {
+			v.decoded = gifMetadata(g)
+			// GIFs are only optimized if they can be drawn
+			if keep && fitsFlattened(g) {
+				v.gif = g
+			}
+		}
+		v.errs <- err
+	}()
+	return v
+}
+
+func (v *validator) Write(p []byte) (int, error) {
+	// A decoding error shouldn't interrupt the upload, so keep accepting
+	// writes and report the error from finish instead. The budget sees
+	// each write before the decoder does, so the decoder is stopped before
+	// it gets to the frame that's over it.
+	if v.budget.err == nil {
+		v.budget.Write(p)
+		if v.budget.err != nil {
+			v.w.CloseWithError(v.budget.err)
+		}
+	}
+	v.w.Write(p)
+	return len(p), nil
+}
+
+// finish tells the validator the upload is over, and returns the
+// upload's metadata, PartTooLargeError if it has more pixels than
+// MaxGIFPixels, or CorruptImageError if it couldn't be decoded. If the
+// upload itself failed, err is passed along to the decoder.
+func (v *validator) finish(err error) (Metadata, error) {
+	v.w.CloseWithError(err)
+	decodeErr := <-v.errs
+	if v.budget.err != nil {
+		return Metadata{}, v.budget.err
+	}
+	if decodeErr == PartTooLargeError {
+		return Metadata{}, decodeErr
+	}
+	if decodeErr != nil {
+		return Metadata{}, CorruptImageError
+	}
+	return v.decoded, nil
+}
+
+// decodeGIF decodes a GIF that's going to have its frames drawn at its
+// full size, by compositeFrames. It fails with PartTooLargeError as soon as
+// that's found to come to more than MaxGIFPixels, before the frames that
+// don't fit are decoded.
+func decodeGIF(r io.Reader) (*gif.GIF, error) {
+	b := newGIFBudget()
+	b.flattened = true
+	g, err := gif.DecodeAll(budgetReader{r: r, budget: b})
+	if b.err != nil {
+		return nil, b.err
+	}
+	return g, err
+}
+
+// budgetReader passes everything read from r through budget on its way
+// to the reader, and stops once the budget's been used up.
+type budgetReader struct {
+	r      io.Reader
+	budget *gifBudget
+}
+
+func (br budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if _, budgetErr := br.budget.Write(p[:n]); budgetErr != nil {
+		return 0, budgetErr
+	}
+	return n, err
+}
+
+// gifBudget follows the blocks of a GIF as it's written, without decoding
+// it, adding up the area of its frames. If flattened is set, every frame
+// counts as the size of the whole GIF instead, as it will once it's drawn
+// by compositeFrames. Once the GIF is found to be bigger than
+// MaxGIFPixels, err is set to PartTooLargeError and nothing more is read.
+// Anything that isn't laid out like a GIF is left for the decoder to
+// reject.
+type gifBudget struct {
+	flattened bool
+	screen    int64
+	pixels    int64
+	err       error
+
+	buf  []byte
+	want int            // bytes needed before next is called
+	skip bool           // whether the wanted bytes are thrown away
+	next func(b []byte) // handles the wanted bytes; nil once done
+}
+
+func newGIFBudget() *gifBudget {
+	b := &gifBudget{}
+	b.expect(13, b.header)
+	return b
+}
+
+// expect calls f with the next n bytes.
+func (b *gifBudget) expect(n int, f func([]byte)) {
+	b.buf, b.want, b.skip, b.next = b.buf[:0], n, false, f
+}
+
+// skipThen throws away the next n bytes, then calls f.
+func (b *gifBudget) skipThen(n int, f func([]byte)) {
+	b.buf, b.want, b.skip, b.next = b.buf[:0], n, true, f
+}
+
+func (b *gifBudget) Write(p []byte) (int, error) {
+	written := len(p)
+	for b.next != nil && b.err == nil {
+		if b.want > 0 {
+			if len(p) == 0 {
+				break
+			}
+			n := b.want
+			if n > len(p) {
+				n = len(p)
+			}
+			if !b.skip {
+				b.buf = append(b.buf, p[:n]...)
+			}
+			p = p[n:]
+			b.want -= n
+			if b.want > 0 {
+				continue
+			}
+		}
+		b.next(b.buf)
+	}
+	return written, b.err
+}
+
+// fits checks that pixels more pixels fit the budget, and counts them if
+// they do.
+func (b *gifBudget) fits(pixels int64) bool {
+	if b.pixels+pixels > MaxGIFPixels {
+		b.err = PartTooLargeError
+		return false
+	}
+	b.pixels += pixels
+	return true
+}
+
+// colorTableSize is how many bytes of color table follow a block with
+// the given flags.
+func colorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 << ((flags & 0x07) + 1)
+}
+
+// header is the GIF's signature and logical screen descriptor.
+func (b *gifBudget) header(p []byte) {
+	if sig := string(p[:6]); sig != "GIF87a" && sig != "GIF89a" {
+		b.next = nil
+		return
+	}
+	b.screen = int64(binary.LittleEndian.Uint16(p[6:])) * int64(binary.LittleEndian.Uint16(p[8:]))
+	if b.flattened && b.screen > MaxGIFPixels {
+		b.err = PartTooLargeError
+		return
+	}
+	b.skipThen(colorTableSize(p[10]), b.block)
+}
+
+func (b *gifBudget) block([]byte) {
+	b.expect(1, b.introducer)
+}
+
+func (b *gifBudget) introducer(p []byte) {
+	switch p[0] {
+	case 0x21: // extension
+		b.skipThen(1, b.subBlocks)
+	case 0x2c: // image descriptor
+		b.expect(9, b.descriptor)
+	default: // the trailer, or not a GIF
+		b.next = nil
+	}
+}
+
+func (b *gifBudget) descriptor(p []byte) {
+	area := int64(binary.LittleEndian.Uint16(p[4:])) * int64(binary.LittleEndian.Uint16(p[6:]))
+	if b.flattened && b.screen > area {
+		area = b.screen
+	}
+	if !b.fits(area) {
+		return
+	}
+	// the color table is followed by the LZW minimum code size
+	b.skipThen(colorTableSize(p[8])+1, b.subBlocks)
+}
+
+func (b *gifBudget) subBlocks([]byte) {
+	b.expect(1, b.subBlock)
+}
+
+func (b *gifBudget) subBlock(p []byte) {
+	if p[0] == 0 {
+		b.block(nil)
+		return
+	}
+	b.skipThen(int(p[0]), b.subBlocks)
+}
+
+func gifMetadata(g *gif.GIF) Metadata {
+	m := Metadata{
+		Width:     g.Config.Width,
+		Height:    g.Config.Height,
+		Frames:    len(g.Image),
+		LoopCount: g.LoopCount,
+	}
+	for _, delay := range g.Delay {
+		// delays are in hundredths of a second
+		m.Duration += delay * 10
+	}
+	return m
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// framesGIF lays out a GIF with frames of the given sizes without encoding
+// any pixels, so it can claim frames far bigger than it is.
+func framesGIF(width, height uint16, frames int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("GIF89a")
+	binary.Write(&buf, binary.LittleEndian, []uint16{width, height})
+	buf.Write([]byte{0x80, 0, 0}) // a two-color global color table follows
+	buf.Write([]byte{0, 0, 0, 255, 255, 255})
+	for i := 0; i < frames; i++ {
+		buf.WriteByte(0x2c)
+		binary.Write(&buf, binary.LittleEndian, []uint16{0, 0, width, height})
+		buf.WriteByte(0)
+		buf.Write([]byte{2, 2, 0x4c, 0x01, 0})
+	}
+	buf.WriteByte(0x3b)
+	return buf.Bytes()
+}
+
+func encodedGIF(t *testing.T, g *gif.GIF) []byte {
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFBudget(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 8, 6), pal),
+			image.NewPaletted(image.Rect(2, 2, 5, 4), pal),
+		},
+		Delay: []int{10, 10},
+	}
+	g.Image[0].Palette = append(color.Palette{}, pal...) // a local color table
+	data := encodedGIF(t, g)
+
+	b := newGIFBudget()
+	// the budget has to follow the GIF however it's split up
+	for i := range data {
+		b.Write(data[i : i+1])
+	}
+	if b.err != nil {
+		t.Errorf("Unexpected error: %s", b.err)
+	}
+	if b.next != nil {
+		t.Error("Expected the budget to reach the trailer")
+	}
+	if b.pixels != 8*6+3*2 {
+		t.Errorf("Expected %d pixels, got %d", 8*6+3*2, b.pixels)
+	}
+}
+
+func TestValidatorPixelBudget(t *testing.T) {
+	big := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black})
+	cases := map[string]struct {
+		data     []byte
+		expected error
+	}{
+		"huge frame":     {framesGIF(65535, 65535, 1), PartTooLargeError},
+		"too many":       {framesGIF(4096, 4096, 5), PartTooLargeError},
+		"huge screen":    {encodedGIF(t, &gif.GIF{Image: []*image.Paletted{big}, Delay: []int{0}, Config: image.Config{Width: 65535, Height: 65535}}), PartTooLargeError},
+		"not a gif":      {[]byte("GIF89a" + string(bytes.Repeat([]byte{0xff}, 64))), CorruptImageError},
+		"within budget":  {encodedGIF(t, &gif.GIF{Image: []*image.Paletted{big}, Delay: []int{0}}), nil},
+		"corrupt frames": {framesGIF(64, 64, 2), CorruptImageError},
+	}
+	for name, tc := range cases {
+		v := newValidator("image/gif", false)
+		v.Write(tc.data)
+		_, err := v.finish(nil)
+		if err != tc.expected {
+			t.Errorf("%s: expected %v, got %v", name, tc.expected, err)
+		}
+	}
+}
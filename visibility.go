@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// Blobs from public collections and blobs from everywhere else are kept
+// apart, so content that's in both a public and a private collection isn't
+// made public by the public one.
+const privateBlobPrefix = "private/"
+
+// blobName is where a blob with the given hash is stored.
+func blobName(hash string, public bool) string {
+	if public {
+		return hash
+	}
+	return privateBlobPrefix + hash
+}
+
+// moveCollectionBlobs moves the blobs of every item in a collection to
+// where blobs are kept for collections that are public, or not, and
+// removes the blobs they were moved from if nothing else uses them.
+func moveCollectionBlobs(ctx context.Context, c Context, slug string, public bool) error {
+	items, err := c.Datastore.GetCollectionItems(slug)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		moved := item
+		moved.Blob, err = moveBlob(ctx, c, item.Bucket, item.Blob, public)
+		if err != nil {
+			return err
+		}
+		if item.OriginalBlob != "" {
+			moved.OriginalBlob, err = moveBlob(ctx, c, item.Bucket, item.OriginalBlob, public)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = c.Datastore.AddItemToCollection(slug, moved, ConflictOverwrite)
+		if err != nil {
+			return err
+		}
+		removeUnusedBlob(ctx, c, item.Bucket, item.Blob)
+		if item.OriginalBlob != "" {
+			removeUnusedBlob(ctx, c, item.Bucket, item.OriginalBlob)
+		}
+	}
+	return nil
+}
+
+// moveBlob copies blob, and its previews, to where it belongs for a
+// collection that's public or not, and returns the name it was copied to.
+// The blob it was copied from is left alone, since other items can still
+// be using it.
+func moveBlob(ctx context.Context, c Context, bucket, blob string, public bool) (string, error) {
+	dst := blobName(strings.TrimPrefix(blob, privateBlobPrefix), public)
+	if dst == blob {
+		return blob, nil
+	}
+	objects := GetObjectStorage(c)
+	tmp := "tmp/" + uuid.NewRandom().String()
+	_, err := objects.Copy(ctx, bucket, blob, bucket, tmp)
+	if err != nil {
+		return "", err
+	}
+	// moveIntoPlace takes care of making the blob public, or of leaving it
+	// as it is when it's already there. Renditions aren't copied; they're
+	// made again under the new name when they're next asked for.
+	err = moveIntoPlace(c, bucket, tmp, bucket, dst, public)
+	if err != nil {
+		del(bucket, tmp, c)
+		return "", err
+	}
+	for _, preview := range previewNames(c, blob) {
+		_, err = objects.Copy(ctx, bucket, preview, bucket, strings.Replace(preview, blob, dst, 1))
+		if err != nil && err != BlobNotFoundError && err != BucketNotFoundError {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+// removeUnusedBlob deletes blob, its previews and its renditions if no item
+// uses it any more. Nothing stops an upload of the same content from
+// landing on blob while it's being deleted, which leaves that upload's item
+// without it.
+func removeUnusedBlob(ctx context.Context, c Context, bucket, blob string) {
+	n, err := c.Datastore.CountBlobReferences(bucket, blob)
+	if err != nil {
+		log.Printf("Error counting references to %s in %s: %s\n", blob, bucket, err)
+		return
+	}
+	if n > 0 {
+		return
+	}
+	objects := GetObjectStorage(c)
+	names := append(previewNames(c, blob), renditionNames(blob)...)
+	for _, name := range append(names, blob) {
+		err = objects.Delete(ctx, bucket, name)
+		if err != nil && err != BlobNotFoundError && err != BucketNotFoundError {
+			log.Printf("Error deleting %s in %s: %s\n", name, bucket, err)
+		}
+	}
+}
+
+func previewNames(c Context, blob string) []string {
+	names := []string{posterName(blob)}
+	for _, size := range c.thumbnailSizes() {
+		names = append(names, thumbnailName(blob, size))
+	}
+	return names
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"secondbit.org/gifs/api/gcstest"
+)
+
+func TestMoveCollectionBlobs(t *testing.T) {
+	srv := gcstest.NewServer()
+	defer srv.Close()
+	s, err := NewGCSStorageFromClient(srv.Client(), srv.BasePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Context{Storage: s, Datastore: NewMemDatastore(), Bucket: "gifs", ThumbnailSizes: []int{100}}
+	ctx := context.Background()
+	objects := GetObjectStorage(c)
+	for _, name := range []string{"tmp/a", "tmp/b"} {
+		_, err = objects.Put(ctx, "gifs", name, strings.NewReader(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = moveIntoPlace(c, "gifs", "tmp/a", "gifs", "abc", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = moveIntoPlace(c, "gifs", "tmp/b", "gifs", "def", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{posterName("abc"), thumbnailName("abc", 100)} {
+		_, err = objects.Put(ctx, "gifs", name, strings.NewReader(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, slug := range []string{"reactions", "cats"} {
+		_, err = c.Datastore.CreateCollection(slug, slug, "alice", VisibilityPublic)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := []struct {
+		slug string
+		item Item
+	}{
+		{"reactions", Item{Tag: "shipit", Blob: "abc", Bucket: "gifs"}},
+		{"reactions", Item{Tag: "wave", Blob: "def", Bucket: "gifs"}},
+		{"cats", Item{Tag: "purr", Blob: "def", Bucket: "gifs"}},
+	}
+	for _, i := range items {
+		_, err = c.Datastore.AddItemToCollection(i.slug, i.item, ConflictReject)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = moveCollectionBlobs(ctx, c, "reactions", false)
+	if err != nil {
+		t.Fatalf("Error making blobs private: %s", err)
+	}
+	for tag, blob := range map[string]string{"shipit": "private/abc", "wave": "private/def"} {
+		item, err := c.Datastore.GetItemFromCollection("reactions", tag)
+		if err != nil || item.Blob != blob {
+			t.Errorf("Expected %s to use %s, got %q, %v", tag, blob, item.Blob, err)
+		}
+		if _, ok := srv.Object("gifs", blob); !ok || srv.IsPublic("gifs", blob) {
+			t.Errorf("Expected %s to exist and be private", blob)
+		}
+	}
+	if _, ok := srv.Object("gifs", "abc"); ok {
+		t.Errorf("Expected the unused public blob to be removed")
+	}
+	if !srv.IsPublic("gifs", "def") {
+		t.Errorf("Expected a public blob still used by a public collection to stay public")
+	}
+	for _, name := range []string{posterName("private/abc"), thumbnailName("private/abc", 100)} {
+		if _, ok := srv.Object("gifs", name); !ok {
+			t.Errorf("Expected %s to be copied", name)
+		}
+	}
+	if _, ok := srv.Object("gifs", posterName("abc")); ok {
+		t.Errorf("Expected the unused blob's poster to be removed")
+	}
+
+	err = moveCollectionBlobs(ctx, c, "reactions", true)
+	if err != nil {
+		t.Fatalf("Error making blobs public: %s", err)
+	}
+	item, err := c.Datastore.GetItemFromCollection("reactions", "shipit")
+	if err != nil || item.Blob != "abc" || !srv.IsPublic("gifs", "abc") {
+		t.Errorf("Expected shipit to be back in a public blob, got %q, %v", item.Blob, err)
+	}
+	if _, ok := srv.Object("gifs", "private/abc"); ok {
+		t.Errorf("Expected the unused private blob to be removed")
+	}
+}